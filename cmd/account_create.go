@@ -23,10 +23,15 @@ import (
 var accountCreateCmd = &cobra.Command{
 	Use:   "create <username>",
 	Short: "Create an account",
-	Long:  `Creates an account using the supplied username, then returns a password.`,
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Creates an account using the supplied username, then returns a password.
+The role is one of admin, user and read-only.`,
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		server.CreateAccount(args[0])
+		role, err := cmd.Flags().GetString("role")
+		if err != nil {
+			panic(err)
+		}
+		server.CreateAccount(args[0], role)
 	},
 }
 
@@ -42,4 +47,5 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// createCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	accountCreateCmd.Flags().String("role", "user", "Role of the account: admin, user or read-only")
 }
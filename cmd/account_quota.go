@@ -0,0 +1,75 @@
+// Copyright © 2019 voidiz
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/voidiz/gohst/server"
+)
+
+// accountQuotaCmd represents the account quota command
+var accountQuotaCmd = &cobra.Command{
+	Use:   "quota",
+	Short: "Manage the quota of an account",
+	Long:  `Shows and changes the storage quota and upload limits of an account.`,
+}
+
+// accountQuotaShowCmd represents the account quota show command
+var accountQuotaShowCmd = &cobra.Command{
+	Use:   "show <username>",
+	Short: "Show the quota of an account",
+	Long:  `Shows the quota of an account along with how much of it is used.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		server.ShowQuota(args[0])
+	},
+}
+
+// accountQuotaSetCmd represents the account quota set command
+var accountQuotaSetCmd = &cobra.Command{
+	Use:   "set <username>",
+	Short: "Set the quota of an account",
+	Long: `Sets the limits of an account that are passed as flags and keeps the others.
+Sizes such as 500M or 10G are powers of 1024 and "unlimited" removes a limit.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flag := func(name string) *string {
+			if !cmd.Flags().Changed(name) {
+				return nil
+			}
+			v, _ := cmd.Flags().GetString(name)
+			return &v
+		}
+		server.SetQuota(args[0], flag("bytes"), flag("files"), flag("file-size"),
+			flag("daily"))
+	},
+}
+
+func init() {
+	accountCmd.AddCommand(accountQuotaCmd)
+	accountQuotaCmd.AddCommand(accountQuotaShowCmd)
+	accountQuotaCmd.AddCommand(accountQuotaSetCmd)
+
+	accountQuotaSetCmd.Flags().String("bytes", "", "Total size of the account's files")
+	accountQuotaSetCmd.Flags().String("files", "", "Number of files")
+	accountQuotaSetCmd.Flags().String("file-size", "", "Size of a single file")
+	accountQuotaSetCmd.Flags().String("daily", "", "Volume uploaded in 24 hours")
+}
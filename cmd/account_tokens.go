@@ -0,0 +1,82 @@
+// Copyright © 2019 voidiz
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/voidiz/gohst/server"
+)
+
+// accountTokensCmd represents the account tokens command
+var accountTokensCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "Manage the bearer tokens of an account",
+	Long:  `Lists and revokes the bearer tokens created by logging in to an account.`,
+}
+
+// accountTokensListCmd represents the account tokens list command
+var accountTokensListCmd = &cobra.Command{
+	Use:   "list <username>",
+	Short: "List the tokens of an account",
+	Long:  `Lists the unexpired tokens of an account along with when they were last used.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		server.ListTokens(args[0])
+	},
+}
+
+// accountTokensRevokeCmd represents the account tokens revoke command
+var accountTokensRevokeCmd = &cobra.Command{
+	Use:   "revoke <username> [id]",
+	Short: "Revoke tokens of an account",
+	Long: `Revokes the token with the supplied ID, as shown by "account tokens list",
+or all tokens of the account with --all.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+		if all && len(args) == 1 || !all && len(args) == 2 {
+			return nil
+		}
+		return errors.New("requires a username and either a token ID or --all")
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		id := 0
+		if len(args) == 2 {
+			var err error
+			id, err = strconv.Atoi(args[1])
+			if err != nil || id <= 0 {
+				cmd.PrintErrln("Invalid token ID")
+				return
+			}
+		}
+		server.RevokeTokens(args[0], id)
+	},
+}
+
+func init() {
+	accountCmd.AddCommand(accountTokensCmd)
+	accountTokensCmd.AddCommand(accountTokensListCmd)
+	accountTokensCmd.AddCommand(accountTokensRevokeCmd)
+
+	accountTokensRevokeCmd.Flags().Bool("all", false, "Revoke every token of the account")
+}
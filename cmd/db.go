@@ -0,0 +1,77 @@
+// Copyright © 2019 voidiz
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/voidiz/gohst/server"
+)
+
+// dbCmd represents the db command
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Database-related commands",
+	Long:  `Applies, rolls back and lists the migrations of the database schema.`,
+}
+
+// dbMigrateCmd represents the db migrate command
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply pending migrations",
+	Long:  `Applies the migrations that haven't been applied to the database yet.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		server.Migrate()
+	},
+}
+
+// dbStatusCmd represents the db status command
+var dbStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List migrations",
+	Long:  `Lists the migrations along with when they were applied.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		server.MigrationStatus()
+	},
+}
+
+// dbRollbackCmd represents the db rollback command
+var dbRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Roll back migrations",
+	Long: `Rolls back the last applied migration, or as many as set by --steps.
+Rolling back may delete data, so it has to be confirmed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		steps, _ := cmd.Flags().GetInt("steps")
+		server.Rollback(steps)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCmd.AddCommand(dbStatusCmd)
+	dbCmd.AddCommand(dbRollbackCmd)
+
+	dbRollbackCmd.Flags().Int("steps", 1, "Number of migrations to roll back")
+}
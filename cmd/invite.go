@@ -0,0 +1,69 @@
+// Copyright © 2019 voidiz
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/voidiz/gohst/server"
+)
+
+// inviteCmd represents the invite command
+var inviteCmd = &cobra.Command{
+	Use:   "invite",
+	Short: "Invite-related commands",
+	Long: `Creates and manages the invite codes that let people register an account
+when registration.enabled is set.`,
+}
+
+// inviteListCmd represents the invite list command
+var inviteListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List invites",
+	Long:  `Lists the invites that haven't expired or been used up.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		server.ListInvites()
+	},
+}
+
+// inviteRevokeCmd represents the invite revoke command
+var inviteRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke an invite",
+	Long:  `Revokes the invite with the supplied ID, as shown by "invite list".`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			cmd.PrintErrln("Invalid invite ID")
+			return
+		}
+		server.RevokeInvite(id)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inviteCmd)
+	inviteCmd.AddCommand(inviteListCmd)
+	inviteCmd.AddCommand(inviteRevokeCmd)
+}
@@ -0,0 +1,62 @@
+// Copyright © 2019 voidiz
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/voidiz/gohst/server"
+)
+
+// inviteCreateCmd represents the invite create command
+var inviteCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create an invite",
+	Long: `Creates an invite code that can be used to register the supplied number of
+accounts. The accounts get the role and quota set by the flags, see
+"account quota set" for the format of the quota limits.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		uses, _ := cmd.Flags().GetInt("uses")
+		expires, _ := cmd.Flags().GetString("expires")
+		role, _ := cmd.Flags().GetString("role")
+		flag := func(name string) *string {
+			if !cmd.Flags().Changed(name) {
+				return nil
+			}
+			v, _ := cmd.Flags().GetString(name)
+			return &v
+		}
+		server.CreateInvite(uses, expires, role, flag("bytes"), flag("files"),
+			flag("file-size"), flag("daily"))
+	},
+}
+
+func init() {
+	inviteCmd.AddCommand(inviteCreateCmd)
+
+	inviteCreateCmd.Flags().Int("uses", 1, "Number of accounts the invite can create")
+	inviteCreateCmd.Flags().String("expires", "7d", "How long the invite is valid, 0 means forever")
+	inviteCreateCmd.Flags().String("role", "user", "Role of the accounts: admin, user or read-only")
+	inviteCreateCmd.Flags().String("bytes", "", "Total size of the files of each account")
+	inviteCreateCmd.Flags().String("files", "", "Number of files of each account")
+	inviteCreateCmd.Flags().String("file-size", "", "Size of a single file")
+	inviteCreateCmd.Flags().String("daily", "", "Volume each account may upload in 24 hours")
+}
@@ -71,6 +71,16 @@ func init() {
 
 	staticDir := filepath.Join(home, "gohst-static-files")
 	viper.SetDefault("staticDir", staticDir)
+	viper.SetDefault("db.driver", "mysql")
+	viper.SetDefault("db.host", "127.0.0.1")
+	viper.SetDefault("db.name", "gohst")
+	viper.SetDefault("db.tls", "disable")
+	viper.SetDefault("db.maxIdleConns", 2)
+	viper.SetDefault("db.connMaxLifetime", "0")
+	viper.SetDefault("db.path", filepath.Join(home, "gohst.db"))
+	viper.SetDefault("storage.backend", "local")
+	viper.SetDefault("storage.s3.region", "us-east-1")
+	viper.SetDefault("storage.s3.useSSL", true)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -21,6 +21,9 @@
 package cmd
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/voidiz/gohst/server"
@@ -53,9 +56,24 @@ func init() {
 	// is called directly, e.g.:
 	// serveCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	serveCmd.Flags().BoolP("development", "d", false, "Start the development server")
+	serveCmd.Flags().Bool("migrate", false, "Apply pending database migrations before starting")
+	viper.BindPFlag("db.migrate", serveCmd.Flags().Lookup("migrate"))
 
 	// Default configuration
 	viper.SetDefault("port", 80)
 	viper.SetDefault("maxFileSize", int64(5000000))
 	viper.SetDefault("blockedMimeTypes", []string{"application/x-dosexec", "application/x-executable"})
+	viper.SetDefault("expiry.default", "0")
+	viper.SetDefault("expiry.max", "0")
+	viper.SetDefault("scanInterval", "1h")
+	viper.SetDefault("shutdownGrace", "30s")
+	viper.SetDefault("tokens.ttl", "30d")
+	viper.SetDefault("tokens.maxTTL", "0")
+	viper.SetDefault("passwords.minLength", 12)
+	viper.SetDefault("registration.enabled", false)
+	viper.SetDefault("unlockTTL", "1h")
+	viper.SetDefault("signing.expiry", "1h")
+	viper.SetDefault("signing.maxExpiry", "7d")
+	viper.SetDefault("tus.dir", filepath.Join(os.TempDir(), "gohst-tus"))
+	viper.SetDefault("tus.expiry", "24h")
 }
@@ -6,96 +6,217 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/voidiz/gohst/storage"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// CreateAccount creates an account using the supplied username,
+// Account roles. Admins can manage other accounts through the admin API
+// and read-only accounts can't upload or delete files.
+const (
+	roleAdmin    = "admin"
+	roleUser     = "user"
+	roleReadOnly = "read-only"
+)
+
+// CreateAccount creates an account with the supplied username and role,
 // then returns a randomly generated password.
-func CreateAccount(newUser string) {
+func CreateAccount(newUser, role string) {
 	db := Initialize()
 
-	var user User
-	err := db.QueryRowx("SELECT * FROM users WHERE username=?", newUser).
-		StructScan(&user)
-	if err != nil && err != sql.ErrNoRows {
+	pass, err := createUser(db, newUser, role)
+	if err != nil {
+		if ae, ok := err.(*apiError); ok {
+			fmt.Println(ae.Message)
+			os.Exit(1)
+		}
 		panic(err)
 	}
 
-	if user.Username != "" {
-		fmt.Println("Username already taken!")
-		os.Exit(1)
-	}
+	fmt.Printf("Created user \"%s\".\nPassword:\n%s\n", newUser, pass)
+}
 
-	pass, err := generatePassword()
-	if err != nil {
-		panic(err)
-	}
+// RegeneratePassword creates a new password for the supplied username
+func RegeneratePassword(user string) {
+	db := Initialize()
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	pass, err := resetPassword(db, user)
 	if err != nil {
+		if err == errUserNotFound {
+			fmt.Printf("User \"%s\" does not exist!\n", user)
+			os.Exit(1)
+		}
 		panic(err)
 	}
 
-	db.MustExec("INSERT INTO users (username, password) VALUES (?, ?)",
-		newUser, hashed)
-	fmt.Printf("Created user \"%s\".\nPassword:\n%s\n", newUser, pass)
+	fmt.Printf("Successfully changed password for \"%s\"!\nPassword:\n%s\n",
+		user, pass)
 }
 
-// RegeneratePassword creates a new password for the supplied username
-func RegeneratePassword(user string) {
+// DeleteAccount deletes an account using the supplied username
+func DeleteAccount(user string) {
 	db := Initialize()
 
-	var usercheck User
-	err := db.QueryRowx("SELECT * FROM users WHERE username=?", user).
-		StructScan(&usercheck)
+	store, err := NewStorage()
 	if err != nil {
-		if err == sql.ErrNoRows {
+		panic(err)
+	}
+
+	if err := deleteUser(db, store, user); err != nil {
+		if err == errUserNotFound {
 			fmt.Printf("User \"%s\" does not exist!\n", user)
 			os.Exit(1)
 		}
 		panic(err)
 	}
 
+	fmt.Printf("Successfully deleted user \"%s\"!\n", user)
+}
+
+// createUser creates an account and returns its randomly generated
+// password
+func createUser(db *DB, username, role string) (string, error) {
 	pass, err := generatePassword()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	_, err = insertUser(db, username, role, pass)
+	return pass, err
+}
+
+// insertUser creates an account with the supplied password and returns
+// its ID
+func insertUser(db queryer, username, role, password string) (int, error) {
+	if !validUsername(username) {
+		return 0, errInvalidUsername
+	}
+	if !validRole(role) {
+		return 0, errInvalidRole
+	}
+
+	var n int
+	if err := db.Get(&n, "SELECT COUNT(*) FROM users WHERE username=?", username); err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, errUsernameTaken
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
-	_, err = db.Exec("UPDATE users SET password=? WHERE username=?", hashed, user)
+	_, err = db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)",
+		username, hashed, role)
 	if err != nil {
-		panic(err)
+		// Taken since the check above
+		if isDuplicate(err) {
+			return 0, errUsernameTaken
+		}
+		return 0, err
 	}
 
-	fmt.Printf("Successfully changed password for \"%s\"!\nPassword:\n%s\n",
-		user, pass)
+	var id int
+	err = db.Get(&id, "SELECT id FROM users WHERE username=?", username)
+	return id, err
 }
 
-// DeleteAccount deletes an account using the supplied username
-func DeleteAccount(user string) {
-	db := Initialize()
+// resetPassword replaces the password of an account with a randomly
+// generated one and returns it. The login tokens and API keys of the
+// account are revoked along with the old password, which may have been
+// used to create them.
+func resetPassword(db *DB, username string) (string, error) {
+	pass, err := generatePassword()
+	if err != nil {
+		return "", err
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	err = inTx(db, func(tx *Tx) error {
+		var id int
+		err := tx.Get(&id, "SELECT id FROM users WHERE username=?", username)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return errUserNotFound
+			}
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE users SET password=? WHERE id=?", hashed, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM auth_tokens WHERE account_id=?", id); err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM api_keys WHERE account_id=?", id)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return pass, nil
+}
 
-	var usercheck User
-	err := db.QueryRowx("SELECT * FROM users WHERE username=?", user).
-		StructScan(&usercheck)
+// deleteUser deletes an account along with its files
+func deleteUser(db *DB, store storage.Storage, username string) error {
+	var user User
+	err := db.Get(&user, "SELECT * FROM users WHERE username=?", username)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			fmt.Printf("User \"%s\" does not exist!\n", user)
-			os.Exit(1)
+			return errUserNotFound
 		}
-		panic(err)
+		return err
 	}
 
-	_, err = db.Exec("DELETE FROM users WHERE username=?", user)
+	var keys []string
+	err = inTx(db, func(tx *Tx) error {
+		var hashes []string
+		err := tx.Select(&hashes, "SELECT blob_hash FROM user_files WHERE account_id=?",
+			user.ID)
+		if err != nil {
+			return err
+		}
+
+		// The user's files are deleted along with the user
+		if _, err := tx.Exec("DELETE FROM users WHERE id=?", user.ID); err != nil {
+			return err
+		}
+
+		for _, hash := range hashes {
+			key, err := dropBlobRef(tx, hash)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Printf("Successfully deleted user \"%s\"!\n", user)
+
+	for _, key := range keys {
+		if err := deleteContent(store, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validUsername(username string) bool {
+	return username != "" && len(username) <= 255 &&
+		!strings.ContainsAny(username, " \t\r\n/")
+}
+
+func validRole(role string) bool {
+	return role == roleAdmin || role == roleUser || role == roleReadOnly
 }
 
 func generatePassword() (string, error) {
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// The admin API lets accounts with the admin role manage other accounts.
+// API keys need the admin scope on top of that.
+
+// userJSON is the JSON representation of an account
+type userJSON struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Suspended bool      `json:"suspended"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newUserJSON(user User) userJSON {
+	return userJSON{
+		ID:        user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		Suspended: user.Suspended,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+// RequireAdmin rejects requests from accounts without the admin role
+func (e *Env) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred := requestCredential(r)
+		if cred.Role != roleAdmin || !cred.hasScope(scopeAdmin) {
+			writeJSONError(w, errAdminOnly)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *Env) APIAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	var users []User
+	if err := e.DB.Select(&users, "SELECT * FROM users ORDER BY id"); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	list := make([]userJSON, len(users))
+	for i, user := range users {
+		list[i] = newUserJSON(user)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Users []userJSON `json:"users"`
+	}{list})
+}
+
+// APIAdminCreateUser creates an account from {"username": ..., "role": ...}
+// and returns it along with its generated password
+func (e *Env) APIAdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}{Role: roleUser}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	pass, err := createUser(e.DB, body.Username, body.Role)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := e.findUser(body.Username)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		userJSON
+		Password string `json:"password"`
+	}{newUserJSON(user), pass})
+}
+
+func (e *Env) APIAdminGetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := e.findUser(chi.URLParam(r, "username"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
+
+// APIAdminUpdateUser changes the role of an account or suspends it with
+// {"role": ..., "suspended": ...}, both optional
+func (e *Env) APIAdminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Role      *string `json:"role"`
+		Suspended *bool   `json:"suspended"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := e.findUser(chi.URLParam(r, "username"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if body.Role != nil {
+		if !validRole(*body.Role) {
+			writeJSONError(w, errInvalidRole)
+			return
+		}
+		user.Role = *body.Role
+	}
+	if body.Suspended != nil {
+		user.Suspended = *body.Suspended
+	}
+
+	// Keep admins from locking themselves out
+	if user.ID == accountID(r) && (user.Role != roleAdmin || user.Suspended) {
+		writeJSONError(w, errOwnAccount)
+		return
+	}
+
+	_, err = e.DB.Exec("UPDATE users SET role=?, suspended=? WHERE id=?",
+		user.Role, user.Suspended, user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
+
+// APIAdminResetPassword replaces the password of an account with a
+// generated one and returns it
+func (e *Env) APIAdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	pass, err := resetPassword(e.DB, chi.URLParam(r, "username"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Password string `json:"password"`
+	}{pass})
+}
+
+// APIAdminDeleteUser deletes an account along with its files
+func (e *Env) APIAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, err := e.findUser(chi.URLParam(r, "username"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if user.ID == accountID(r) {
+		writeJSONError(w, errOwnAccount)
+		return
+	}
+
+	if err := deleteUser(e.DB, e.Storage, user.Username); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIAdminListFiles lists the files of an account like APIListFiles
+func (e *Env) APIAdminListFiles(w http.ResponseWriter, r *http.Request) {
+	user, err := e.findUser(chi.URLParam(r, "username"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	e.writeFileList(w, r, user.ID)
+}
+
+func (e *Env) findUser(username string) (User, error) {
+	var user User
+	err := e.DB.Get(&user, "SELECT * FROM users WHERE username=?", username)
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
+	}
+	return user, err
+}
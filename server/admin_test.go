@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminUsers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, admin := loginTestUser(t, e, "root", roleAdmin)
+		_, user := loginTestUser(t, e, "alice", roleUser)
+
+		if w := serve(h, newRequest(http.MethodGet, "/api/v1/admin/users", user, nil)); w.Code != http.StatusForbidden {
+			t.Errorf("got %d listing users as a user, want %d", w.Code,
+				http.StatusForbidden)
+		}
+
+		w := serve(h, newRequest(http.MethodPost, "/api/v1/admin/users", admin,
+			strings.NewReader(`{"username": "bob", "role": "read-only"}`)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("got %d creating a user: %s", w.Code, w.Body)
+		}
+		var created struct {
+			userJSON
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+		if created.Role != roleReadOnly || created.Password == "" {
+			t.Errorf("created %s with password %q", created.Role, created.Password)
+		}
+		bob, err := e.createAuthToken("bob", created.Password, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w = serve(h, newRequest(http.MethodPatch, "/api/v1/admin/users/bob", admin,
+			strings.NewReader(`{"role": "overlord"}`)))
+		if w.Code != errInvalidRole.Status {
+			t.Errorf("got %d for an invalid role, want %d", w.Code, errInvalidRole.Status)
+		}
+
+		// Suspended accounts can't use the tokens they already have
+		w = serve(h, newRequest(http.MethodPatch, "/api/v1/admin/users/bob", admin,
+			strings.NewReader(`{"suspended": true}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d suspending a user", w.Code)
+		}
+		if w := serve(h, newRequest(http.MethodGet, "/api/v1/files", bob, nil)); w.Code != errAccountSuspended.Status {
+			t.Errorf("got %d with the token of a suspended account, want %d", w.Code,
+				errAccountSuspended.Status)
+		}
+		if _, err := e.createAuthToken("bob", created.Password, ""); err != errAccountSuspended {
+			t.Errorf("got %v logging into a suspended account, want %v", err,
+				errAccountSuspended)
+		}
+
+		if w := serve(h, newRequest(http.MethodDelete, "/api/v1/admin/users/bob", admin, nil)); w.Code != http.StatusNoContent {
+			t.Fatalf("got %d deleting a user", w.Code)
+		}
+		if w := serve(h, newRequest(http.MethodGet, "/api/v1/admin/users/bob", admin, nil)); w.Code != http.StatusNotFound {
+			t.Errorf("got %d for a deleted user, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestAdminOwnAccount(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, admin := loginTestUser(t, e, "root", roleAdmin)
+
+		for _, r := range []*http.Request{
+			newRequest(http.MethodPatch, "/api/v1/admin/users/root", admin,
+				strings.NewReader(`{"role": "user"}`)),
+			newRequest(http.MethodPatch, "/api/v1/admin/users/root", admin,
+				strings.NewReader(`{"suspended": true}`)),
+			newRequest(http.MethodDelete, "/api/v1/admin/users/root", admin, nil),
+		} {
+			if w := serve(h, r); w.Code != errOwnAccount.Status {
+				t.Errorf("%s: got %d, want %d", r.Method, w.Code, errOwnAccount.Status)
+			}
+		}
+
+		var user User
+		if err := e.DB.Get(&user, "SELECT * FROM users WHERE username=?", "root"); err != nil {
+			t.Fatal(err)
+		}
+		if user.Role != roleAdmin || user.Suspended {
+			t.Errorf("admin locked out as %s, suspended %t", user.Role, user.Suspended)
+		}
+	})
+}
+
+func TestReadOnlyDenied(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, token := loginTestUser(t, e, "alice", roleReadOnly)
+
+		for _, r := range []*http.Request{
+			newRequest(http.MethodPost, "/api/v1/auth/keys", token,
+				strings.NewReader(`{"name": "k", "scopes": ["list"]}`)),
+			newRequest(http.MethodPut, "/api/v1/files/abcdef.txt/grants/bob", token, nil),
+		} {
+			if w := serve(h, r); w.Code != errReadOnly.Status {
+				t.Errorf("%s %s: got %d, want %d", r.Method, r.URL, w.Code,
+					errReadOnly.Status)
+			}
+		}
+
+		if w := serve(h, newRequest(http.MethodGet, "/api/v1/files", token, nil)); w.Code != http.StatusOK {
+			t.Errorf("got %d listing files as read-only", w.Code)
+		}
+	})
+}
+
+func TestResetPasswordRevokes(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, admin := loginTestUser(t, e, "root", roleAdmin)
+		_, token := loginTestUser(t, e, "alice", roleUser)
+
+		status, key := createTestKey(t, h, token, `{"name": "k", "scopes": ["list"]}`)
+		if status != http.StatusCreated {
+			t.Fatalf("got %d creating a key", status)
+		}
+
+		w := serve(h, newRequest(http.MethodPost, "/api/v1/admin/users/alice/password",
+			admin, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d resetting a password", w.Code)
+		}
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, credential := range []string{token, key.Key} {
+			if w := serve(h, newRequest(http.MethodGet, "/api/v1/files", credential, nil)); w.Code != errInvalidBearerToken.Status {
+				t.Errorf("got %d with a credential from before the reset, want %d",
+					w.Code, errInvalidBearerToken.Status)
+			}
+		}
+		if _, err := e.createAuthToken("alice", body.Password, ""); err != nil {
+			t.Errorf("got %v logging in with the new password", err)
+		}
+
+		if _, err := resetPassword(e.DB, "nobody"); err != errUserNotFound {
+			t.Errorf("got %v resetting a missing account, want %v", err, errUserNotFound)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Handlers of the versioned JSON API mounted at /api/v1. They share their
+// logic with the plain text routes, but always respond with JSON and
+// report errors in the envelope written by writeJSONError.
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// decodeJSON decodes the JSON request body into v. An empty body leaves v
+// untouched.
+func decodeJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, maxFieldSize)).Decode(v)
+	if err != nil && err != io.EOF {
+		return errInvalidJSON
+	}
+	return nil
+}
+
+// APIAuthMiddleware is the JSON API counterpart of AuthMiddleware
+func (e *Env) APIAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, err := e.authenticate(r)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), credentialKey, cred)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (e *Env) APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, errNotFound)
+}
+
+func (e *Env) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, errMethodNotAllowed)
+}
+
+// APICreateToken logs in with {"user": ..., "pass": ..., "ttl": ...} and
+// returns a bearer token
+func (e *Env) APICreateToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		User string `json:"user"`
+		Pass string `json:"pass"`
+		TTL  string `json:"ttl"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	token, err := e.createAuthToken(body.User, body.Pass, body.TTL)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		Token string `json:"token"`
+	}{token})
+}
+
+// APIUploadFile stores a file uploaded as a multipart form, with the same
+// fields as the plain upload route, and returns its metadata
+func (e *Env) APIUploadFile(w http.ResponseWriter, r *http.Request) {
+	file, err := e.uploadFile(w, r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newFileJSON(r, file))
+}
+
+// APIListFiles returns a page of the files of the account, see
+// parseFileQuery for the accepted query parameters
+func (e *Env) APIListFiles(w http.ResponseWriter, r *http.Request) {
+	e.writeFileList(w, r, accountID(r))
+}
+
+// writeFileList writes the page of the files of an account selected by
+// the query parameters of r
+func (e *Env) writeFileList(w http.ResponseWriter, r *http.Request, accountID int) {
+	fq, err := parseFileQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	files, total, err := e.listFiles(accountID, fq)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	list := make([]fileJSON, len(files))
+	for i, file := range files {
+		list[i] = newFileJSON(r, file)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Files   []fileJSON `json:"files"`
+		Page    int        `json:"page"`
+		PerPage int        `json:"per_page"`
+		Total   int        `json:"total"`
+	}{list, fq.Page, fq.PerPage, total})
+}
+
+// APIGetFile returns the metadata of a file the account owns or has been
+// granted the read right on
+func (e *Env) APIGetFile(w http.ResponseWriter, r *http.Request) {
+	file, err := e.fileAccess(accountID(r), chi.URLParam(r, "filename"), permRead)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newFileJSON(r, file))
+}
+
+func (e *Env) APIDeleteFile(w http.ResponseWriter, r *http.Request) {
+	if err := e.deleteFile(accountID(r), chi.URLParam(r, "filename")); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APISignFile creates a signed URL for a private file. The optional body
+// {"expires": "1h", "ip": "true"} works like the form of SignFile.
+func (e *Env) APISignFile(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Expires string `json:"expires"`
+		IP      string `json:"ip"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	signed, expiresAt, err := e.signFileURL(r, chi.URLParam(r, "filename"),
+		body.Expires, body.IP)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{signed, expiresAt})
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// API keys are long-lived credentials for automation. Unlike login tokens
+// they are limited to a set of scopes and can restrict the files uploaded
+// with them. Like login tokens, only the SHA-256 of a key is stored, so a
+// key is shown once when it is created.
+
+// Scopes granted by API keys
+const (
+	scopeUpload = "upload"
+	scopeDelete = "delete"
+	scopeList   = "list"
+	scopeAdmin  = "admin"
+)
+
+var scopes = []string{scopeUpload, scopeDelete, scopeList, scopeAdmin}
+
+// apiKeyPrefix starts every API key, telling them apart from login tokens
+const apiKeyPrefix = "gk_"
+
+// hasScope reports whether the key grants scope
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range splitList(k.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsMimeType reports whether files of mimeType may be uploaded with the
+// key. A pattern such as "image/*" allows every subtype. A nil key allows
+// every type.
+func (k *APIKey) allowsMimeType(mimeType string) bool {
+	if k == nil || k.MimeTypes == "" {
+		return true
+	}
+
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	for _, pattern := range splitList(k.MimeTypes) {
+		if pattern == mimeType || strings.HasSuffix(pattern, "/*") &&
+			strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictTo narrows the restrictions of k, a key being created with the
+// API key parent, to those of parent. The restrictions k leaves out are
+// inherited, wider ones are rejected.
+func (k *APIKey) restrictTo(parent *APIKey) error {
+	if parent.MaxFileSize != nil {
+		if k.MaxFileSize == nil {
+			k.MaxFileSize = parent.MaxFileSize
+		} else if *k.MaxFileSize > *parent.MaxFileSize {
+			return errInvalidKeyLimit
+		}
+	}
+
+	if parent.MimeTypes != "" {
+		if k.MimeTypes == "" {
+			k.MimeTypes = parent.MimeTypes
+		}
+		for _, pattern := range splitList(k.MimeTypes) {
+			if !parent.allowsMimeType(pattern) {
+				return errInvalidMimeTypes
+			}
+		}
+	}
+
+	if parent.ExpiresAt != nil {
+		if k.ExpiresAt == nil {
+			k.ExpiresAt = parent.ExpiresAt
+		} else if k.ExpiresAt.After(*parent.ExpiresAt) {
+			return errInvalidExpiry
+		}
+	}
+	return nil
+}
+
+// uploadLimit returns the size uploads made with key have to stay below
+func (e *Env) uploadLimit(key *APIKey) int64 {
+	if key != nil && key.MaxFileSize != nil && *key.MaxFileSize < e.MaxFileSize {
+		return *key.MaxFileSize + 1
+	}
+	return e.MaxFileSize
+}
+
+// requireScope rejects requests whose credential doesn't grant scope,
+// reporting the error with writeErr
+func requireScope(scope string,
+	writeErr func(http.ResponseWriter, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !requestCredential(r).hasScope(scope) {
+				writeErr(w, errInsufficientScope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// denyReadOnly rejects requests from read-only accounts, which must not
+// hand out access to others through API keys or grants
+func denyReadOnly(writeErr func(http.ResponseWriter, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requestCredential(r).Role == roleReadOnly {
+				writeErr(w, errReadOnly)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authenticateAPIKey looks up an unexpired API key and records that it was
+// used
+func (e *Env) authenticateAPIKey(token string) (APIKey, error) {
+	var key APIKey
+	now := dbNow()
+	hash := hashToken(token)
+	err := e.DB.QueryRowx(`SELECT * FROM api_keys
+		WHERE key_hash=? AND (expires_at IS NULL OR expires_at>?)`,
+		hash, now).StructScan(&key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return key, errInvalidBearerToken
+		}
+		return key, err
+	}
+
+	return key, touch(e.DB, "api_keys", key.ID, now)
+}
+
+// apiKeyJSON is the JSON representation of an API key. Key is only set in
+// the response to its creation.
+type apiKeyJSON struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Key         string     `json:"key,omitempty"`
+	Prefix      string     `json:"prefix"`
+	Scopes      []string   `json:"scopes"`
+	MaxFileSize *int64     `json:"max_file_size"`
+	MimeTypes   []string   `json:"mime_types"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+func newAPIKeyJSON(key APIKey) apiKeyJSON {
+	return apiKeyJSON{
+		ID:          key.ID,
+		Name:        key.Name,
+		Prefix:      key.Prefix,
+		Scopes:      splitList(key.Scopes),
+		MaxFileSize: key.MaxFileSize,
+		MimeTypes:   splitList(key.MimeTypes),
+		ExpiresAt:   key.ExpiresAt,
+		LastUsedAt:  key.LastUsedAt,
+		CreatedAt:   key.CreatedAt,
+	}
+}
+
+// APIListKeys lists the unexpired API keys of the account
+func (e *Env) APIListKeys(w http.ResponseWriter, r *http.Request) {
+	keys := []APIKey{}
+	err := e.DB.Select(&keys, `SELECT * FROM api_keys
+		WHERE account_id=? AND (expires_at IS NULL OR expires_at>?)
+		ORDER BY id`, accountID(r), dbNow())
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	list := make([]apiKeyJSON, len(keys))
+	for i, key := range keys {
+		list[i] = newAPIKeyJSON(key)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Keys []apiKeyJSON `json:"keys"`
+	}{list})
+}
+
+// APICreateKey creates an API key from {"name": ..., "scopes": [...]} and
+// the optional restrictions "max_file_size", "mime_types" and "expires".
+// An API key can only create keys with scopes it has itself and
+// restrictions at least as narrow as its own.
+func (e *Env) APICreateKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name        string   `json:"name"`
+		Scopes      []string `json:"scopes"`
+		MaxFileSize *int64   `json:"max_file_size"`
+		MimeTypes   []string `json:"mime_types"`
+		Expires     string   `json:"expires"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > 255 {
+		writeJSONError(w, errMissingKeyName)
+		return
+	}
+
+	cred := requestCredential(r)
+	if len(body.Scopes) == 0 {
+		writeJSONError(w, errInvalidScopes)
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !validScope(scope) || !cred.hasScope(scope) {
+			writeJSONError(w, errInvalidScopes)
+			return
+		}
+	}
+
+	if body.MaxFileSize != nil && *body.MaxFileSize < 0 {
+		writeJSONError(w, errInvalidKeyLimit)
+		return
+	}
+
+	for i, mimeType := range body.MimeTypes {
+		mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+		if !validTypeFilter(strings.TrimSuffix(mimeType, "/*")) {
+			writeJSONError(w, errInvalidMimeTypes)
+			return
+		}
+		body.MimeTypes[i] = mimeType
+	}
+
+	expiresAt, ok := expiryTime(body.Expires, 0, 0)
+	if !ok {
+		writeJSONError(w, errInvalidExpiry)
+		return
+	}
+
+	key := APIKey{
+		Scopes:      strings.Join(body.Scopes, ","),
+		MaxFileSize: body.MaxFileSize,
+		MimeTypes:   strings.Join(body.MimeTypes, ","),
+		ExpiresAt:   expiresAt,
+	}
+	if cred.Key != nil {
+		if err := key.restrictTo(cred.Key); err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	secret, err := generateToken(32)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	token := apiKeyPrefix + secret
+
+	_, err = e.DB.Exec(`INSERT INTO api_keys
+		(account_id, name, prefix, key_hash, scopes, max_file_size, mime_types, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		cred.AccountID, name, tokenPrefix(token), hashToken(token),
+		key.Scopes, key.MaxFileSize, key.MimeTypes, key.ExpiresAt)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = e.DB.Get(&key, "SELECT * FROM api_keys WHERE key_hash=?", hashToken(token))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	res := newAPIKeyJSON(key)
+	res.Key = token
+	writeJSON(w, http.StatusCreated, res)
+}
+
+// APIRevokeKey revokes an API key of the account
+func (e *Env) APIRevokeKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, errKeyNotFound)
+		return
+	}
+
+	if err := revokeAPIKey(e.DB, accountID(r), id); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func revokeAPIKey(db *DB, accountID, id int) error {
+	res, err := db.Exec("DELETE FROM api_keys WHERE id=? AND account_id=?",
+		id, accountID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errKeyNotFound
+	}
+	return nil
+}
+
+func validScope(scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated column into its values
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// createTestKey creates an API key through the API with the credential
+// token and returns the response status along with the key
+func createTestKey(t *testing.T, h http.Handler, token, body string) (int, apiKeyJSON) {
+	w := serve(h, newRequest(http.MethodPost, "/api/v1/auth/keys", token,
+		strings.NewReader(body)))
+
+	var key apiKeyJSON
+	if w.Code == http.StatusCreated {
+		if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, key
+}
+
+func TestAPICreateKeyRestricted(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, token := loginTestUser(t, e, "alice", roleUser)
+
+		status, parent := createTestKey(t, h, token, `{"name": "parent",
+			"scopes": ["admin", "upload"], "max_file_size": 1000,
+			"mime_types": ["image/*"], "expires": "1h"}`)
+		if status != http.StatusCreated {
+			t.Fatalf("got %d creating the parent key", status)
+		}
+
+		// Restrictions left out are inherited from the parent
+		status, child := createTestKey(t, h, parent.Key, `{"name": "child",
+			"scopes": ["upload"]}`)
+		if status != http.StatusCreated {
+			t.Fatalf("got %d creating a key with a key", status)
+		}
+		if child.MaxFileSize == nil || *child.MaxFileSize != 1000 ||
+			strings.Join(child.MimeTypes, ",") != "image/*" ||
+			child.ExpiresAt == nil || !child.ExpiresAt.Equal(*parent.ExpiresAt) {
+			t.Errorf("got %+v, want the restrictions of the parent key", child)
+		}
+
+		status, _ = createTestKey(t, h, parent.Key, `{"name": "narrower",
+			"scopes": ["upload"], "max_file_size": 500, "mime_types": ["image/png"],
+			"expires": "30m"}`)
+		if status != http.StatusCreated {
+			t.Errorf("got %d creating a key with narrower restrictions", status)
+		}
+
+		for _, c := range []struct {
+			body string
+			err  *apiError
+		}{
+			{`{"name": "c", "scopes": ["list"]}`, errInvalidScopes},
+			{`{"name": "c", "scopes": ["upload"], "max_file_size": 1001}`, errInvalidKeyLimit},
+			{`{"name": "c", "scopes": ["upload"], "mime_types": ["text/plain"]}`, errInvalidMimeTypes},
+			{`{"name": "c", "scopes": ["upload"], "mime_types": ["image/png", "video/*"]}`, errInvalidMimeTypes},
+			{`{"name": "c", "scopes": ["upload"], "expires": "2h"}`, errInvalidExpiry},
+		} {
+			if status, _ := createTestKey(t, h, parent.Key, c.body); status != c.err.Status {
+				t.Errorf("got %d for %s, want %d", status, c.body, c.err.Status)
+			}
+		}
+	})
+}
+
+func TestAllowsMimeType(t *testing.T) {
+	key := &APIKey{MimeTypes: "image/*,text/plain"}
+	for mimeType, allowed := range map[string]bool{
+		"image/png":                 true,
+		"IMAGE/JPEG":                true,
+		"text/plain; charset=utf-8": true,
+		"text/html":                 false,
+		"image":                     false,
+		"application/octet-stream":  false,
+	} {
+		if key.allowsMimeType(mimeType) != allowed {
+			t.Errorf("allowsMimeType(%q) = %t, want %t", mimeType, !allowed, allowed)
+		}
+	}
+
+	var none *APIKey
+	if !none.allowsMimeType("text/html") || !(&APIKey{}).allowsMimeType("text/html") {
+		t.Error("type rejected without a restriction")
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	e := &Env{MaxFileSize: 1000}
+	small, large := int64(100), int64(5000)
+	for _, c := range []struct {
+		key  *APIKey
+		want int64
+	}{
+		{nil, 1000},
+		{&APIKey{}, 1000},
+		{&APIKey{MaxFileSize: &small}, 101},
+		{&APIKey{MaxFileSize: &large}, 1000},
+	} {
+		if got := e.uploadLimit(c.key); got != c.want {
+			t.Errorf("got %d for %+v, want %d", got, c.key, c.want)
+		}
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, token := loginTestUser(t, e, "alice", roleUser)
+
+		status, key := createTestKey(t, h, token, `{"name": "list",
+			"scopes": ["list"]}`)
+		if status != http.StatusCreated {
+			t.Fatalf("got %d creating a key", status)
+		}
+
+		for _, c := range []struct {
+			method, path string
+			status       int
+		}{
+			{http.MethodGet, "/api/v1/files", http.StatusOK},
+			{http.MethodDelete, "/api/v1/files/abcdef.txt", http.StatusForbidden},
+			{http.MethodGet, "/api/v1/auth/keys", http.StatusForbidden},
+			{http.MethodPost, "/", http.StatusForbidden},
+		} {
+			w := serve(h, newRequest(c.method, c.path, key.Key, nil))
+			if w.Code != c.status {
+				t.Errorf("%s %s: got %d, want %d", c.method, c.path, w.Code, c.status)
+			}
+		}
+
+		// Login tokens carry every scope
+		if w := serve(h, newRequest(http.MethodGet, "/api/v1/auth/keys", token, nil)); w.Code != http.StatusOK {
+			t.Errorf("got %d listing keys with a login token", w.Code)
+		}
+	})
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, alice := loginTestUser(t, e, "alice", roleUser)
+		_, bob := loginTestUser(t, e, "bob", roleUser)
+
+		status, key := createTestKey(t, h, alice, `{"name": "list",
+			"scopes": ["list"]}`)
+		if status != http.StatusCreated {
+			t.Fatalf("got %d creating a key", status)
+		}
+		path := fmt.Sprintf("/api/v1/auth/keys/%d", key.ID)
+
+		if w := serve(h, newRequest(http.MethodDelete, path, bob, nil)); w.Code != http.StatusNotFound {
+			t.Errorf("got %d revoking another account's key, want %d", w.Code,
+				http.StatusNotFound)
+		}
+		if w := serve(h, newRequest(http.MethodDelete, path, alice, nil)); w.Code != http.StatusNoContent {
+			t.Fatalf("got %d revoking a key", w.Code)
+		}
+		if _, err := e.authenticateAPIKey(key.Key); err != errInvalidBearerToken {
+			t.Errorf("got %v authenticating with a revoked key, want %v", err,
+				errInvalidBearerToken)
+		}
+		if w := serve(h, newRequest(http.MethodDelete, path, alice, nil)); w.Code != http.StatusNotFound {
+			t.Errorf("got %d revoking a key twice, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/voidiz/gohst/storage"
+)
+
+// Uploaded files are stored once per distinct content as blobs, keyed by
+// the SHA-256 of the content. Every row in user_files holds a reference to
+// a blob and the blob is deleted when the last reference is released.
+//
+// A blob is stored under its hash followed by a random suffix. If a blob is
+// released while the same content is uploaded again, the upload creates a
+// new blob under a different key instead of racing the deletion.
+
+// orphanAge is how long stored content without a blob, or a temporary file
+// of the storage, is left alone before it is reaped. It covers the time
+// between storing a blob and inserting its row.
+const orphanAge = time.Hour
+
+// blobKeyFormat matches the storage keys of blobs
+var blobKeyFormat = regexp.MustCompile("^[0-9a-f]{64}-[0-9a-f]{8}$")
+
+// acquireBlob takes a reference to the blob holding the content of r,
+// storing the content first if there is no such blob yet
+func acquireBlob(db *DB, store storage.Storage, hash string, size int64,
+	r io.Reader) error {
+	ok, err := refBlob(db, hash)
+	if err != nil || ok {
+		return err
+	}
+
+	key, err := blobKey(hash)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Put(key, r); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO blobs (hash, storage_key, size, refs) VALUES (?, ?, ?, 1)",
+		hash, key, size)
+	if err != nil {
+		// Someone else stored the same content in the meantime
+		store.Delete(key)
+		if ok, refErr := refBlob(db, hash); refErr != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// refBlob increments the reference count of a blob, if it exists
+func refBlob(db queryer, hash string) (bool, error) {
+	res, err := db.Exec("UPDATE blobs SET refs=refs+1 WHERE hash=?", hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// releaseBlob drops a reference to a blob and deletes it once it is no
+// longer referenced
+func releaseBlob(db *DB, store storage.Storage, hash string) error {
+	var key string
+	err := inTx(db, func(tx *Tx) error {
+		var err error
+		key, err = dropBlobRef(tx, hash)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return deleteContent(store, key)
+}
+
+// dropBlobRef drops a reference to a blob as part of a transaction. If it
+// was the last one, the blob is deleted and the storage key of its content
+// returned, which is to be deleted once the transaction is committed. If
+// that fails, ReapBlobs deletes the content later on.
+func dropBlobRef(tx *Tx, hash string) (string, error) {
+	_, err := tx.Exec("UPDATE blobs SET refs=refs-1 WHERE hash=?", hash)
+	if err != nil {
+		return "", err
+	}
+	return deleteUnreferencedBlob(tx, hash)
+}
+
+// deleteUnreferencedBlob deletes a blob if it has no references and
+// returns the storage key of its content
+func deleteUnreferencedBlob(db queryer, hash string) (string, error) {
+	var key string
+	err := db.Get(&key, "SELECT storage_key FROM blobs WHERE hash=? AND refs<=0", hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	res, err := db.Exec("DELETE FROM blobs WHERE hash=? AND storage_key=? AND refs<=0",
+		hash, key)
+	if err != nil {
+		return "", err
+	}
+
+	// Only delete the content if nobody took a new reference meanwhile
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return "", err
+	}
+	return key, nil
+}
+
+// deleteContent deletes the content of a blob, if key isn't empty
+func deleteContent(store storage.Storage, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	err := store.Delete(key)
+	if err != nil && err != storage.ErrNotExist {
+		return err
+	}
+	return nil
+}
+
+// ReapBlobs deletes what is left behind when storing or releasing a blob
+// fails halfway: blobs without references, stored content without a blob
+// and the temporary files of the storage
+func (e *Env) ReapBlobs() error {
+	var hashes []string
+	if err := e.DB.Select(&hashes, "SELECT hash FROM blobs WHERE refs<=0"); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		key, err := deleteUnreferencedBlob(e.DB, hash)
+		if err != nil {
+			return err
+		}
+		if err := deleteContent(e.Storage, key); err != nil {
+			return err
+		}
+	}
+
+	// Listed before the blobs are selected, so that content stored in
+	// between has its row by then
+	infos, err := e.Storage.List()
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	if err := e.DB.Select(&keys, "SELECT storage_key FROM blobs"); err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		known[key] = true
+	}
+
+	for _, fi := range infos {
+		if known[fi.Name] || !blobKeyFormat.MatchString(fi.Name) ||
+			time.Since(fi.ModTime) < orphanAge {
+			continue
+		}
+		err := e.Storage.Delete(fi.Name)
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+		log.Printf("Deleted orphaned blob %s\n", fi.Name)
+	}
+
+	if rp, ok := e.Storage.(storage.Reaper); ok {
+		return rp.Reap(orphanAge)
+	}
+	return nil
+}
+
+// blobKey returns a new storage key for a blob with the supplied hash
+func blobKey(hash string) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hash + "-" + hex.EncodeToString(b), nil
+}
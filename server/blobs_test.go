@@ -0,0 +1,82 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voidiz/gohst/storage"
+)
+
+func TestReapBlobs(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		dir, err := ioutil.TempDir("", "gohst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		e.Storage = storage.NewLocal(dir)
+
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storeTestFile(t, e, id, "a.txt", "hello", nil); err != nil {
+			t.Fatal(err)
+		}
+		var stored string
+		if err := e.DB.Get(&stored, "SELECT storage_key FROM blobs"); err != nil {
+			t.Fatal(err)
+		}
+
+		orphan := strings.Repeat("ab", 32) + "-0123abcd"
+		recent := strings.Repeat("cd", 32) + "-0123abcd"
+		old := time.Now().Add(-2 * orphanAge)
+		for name, modTime := range map[string]time.Time{
+			stored:           old,
+			orphan:           old,
+			recent:           time.Now(),
+			"notes.txt":      old,
+			".upload-old":    old,
+			".upload-recent": time.Now(),
+		} {
+			path := filepath.Join(dir, name)
+			if name != stored {
+				if err := ioutil.WriteFile(path, []byte("x"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := e.ReapBlobs(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only old content without a blob and old temporary files go
+		for name, kept := range map[string]bool{
+			stored:           true,
+			orphan:           false,
+			recent:           true,
+			"notes.txt":      true,
+			".upload-old":    false,
+			".upload-recent": true,
+		} {
+			_, err := os.Stat(filepath.Join(dir, name))
+			if exists := err == nil; exists != kept {
+				t.Errorf("%s exists %t, want %t", name, exists, kept)
+			}
+		}
+
+		// The rollback after the test moves content out of the storage it
+		// started with
+		if err := deleteUser(e.DB, e.Storage, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -7,8 +7,8 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
 )
@@ -30,43 +30,70 @@ func CreateConfig() {
 	fmt.Printf("Created configuration file %s!\nDon't forget to fill in your database credentials!\n", path)
 }
 
-// Setup runs the initial setup using the supplied settings in the configuration file
+// Setup runs the initial setup using the supplied settings in the
+// configuration file. It can be run again, the database is only created if
+// it doesn't exist yet and then brought up to date by Migrate.
 func Setup() {
-	db, err := sqlx.Connect("mysql", fmt.Sprintf("%v:%v@tcp(127.0.0.1:3306)/?multiStatements=true",
-		viper.GetString("dbUser"), viper.GetString("dbPass")))
-	if err != nil {
-		panic(err)
+	// With a raw DSN the database has to exist already
+	if viper.GetString("db.dsn") == "" {
+		switch viper.GetString("db.driver") {
+		case driverMySQL:
+			createMySQLDatabase()
+		case driverPostgres:
+			createPostgresDatabase()
+		}
 	}
-	defer db.Close()
 
-	_, err = db.Exec("CREATE DATABASE gohst")
-	if me, ok := err.(*mysql.MySQLError); ok {
-		if me.Number == 1007 {
-			if confirmAction("Database already exists, do you want to delete it?") {
-				db.MustExec("DROP DATABASE gohst; CREATE DATABASE gohst;")
-			} else {
-				fmt.Println("Aborting...")
-				os.Exit(1)
+	Migrate()
+	fmt.Println("Successfully setup the database!")
+
+	if viper.GetString("storage.backend") == "local" {
+		staticDir := viper.GetString("staticDir")
+		if _, err := os.Stat(staticDir); os.IsNotExist(err) {
+			if err := os.Mkdir(staticDir, 0755); err != nil {
+				panic(err)
 			}
-		} else {
-			panic(err)
+			fmt.Printf("Created static file directory %s!\n", staticDir)
 		}
-	} else if !ok {
-		panic(err)
 	}
 
-	db.MustExec(dbStructure)
-	fmt.Println("Successfully setup the database!")
+	fmt.Println("Done with setup!")
+}
 
-	staticDir := viper.GetString("staticDir")
-	if err := os.Mkdir(staticDir, 0755); err != nil {
+// createMySQLDatabase creates the database named by db.name if it doesn't
+// exist
+func createMySQLDatabase() {
+	dsn, err := mysqlDSN("")
+	if err != nil {
 		panic(err)
-	} else {
-		fmt.Printf("Created static file directory %s!\n", staticDir)
 	}
+	db, err := sqlx.Connect(driverMySQL, dsn)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
 
+	name := strings.Replace(viper.GetString("db.name"), "`", "``", -1)
+	db.MustExec("CREATE DATABASE IF NOT EXISTS `" + name + "`")
+}
+
+// createPostgresDatabase creates the database named by db.name if it
+// doesn't exist
+func createPostgresDatabase() {
+	db, err := sqlx.Connect(driverPostgres, postgresDSN("postgres"))
+	if err != nil {
+		panic(err)
+	}
 	defer db.Close()
-	fmt.Println("Done with setup!")
+
+	// Postgres has no CREATE DATABASE IF NOT EXISTS
+	_, err = db.Exec("CREATE DATABASE " + pq.QuoteIdentifier(viper.GetString("db.name")))
+	if pe, ok := err.(*pq.Error); ok && pe.Code == "42P04" {
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
 }
 
 func confirmAction(action string) bool {
@@ -88,55 +115,70 @@ func confirmAction(action string) bool {
 
 var configText = `##############################################
 ## 			  db configuration				##
-##  *note: db has to be on localhost:3306	##
 ##############################################
-# dbUser:
+# db:
+#   driver: mysql			# mysql, postgres or sqlite
+#   host: 127.0.0.1
+#   port: 0					# defaults to 3306 for mysql and 5432 for postgres
+#   socket:					# unix socket used instead of host and port: the socket
+#							# file for mysql, the directory holding it for postgres
+#   name: gohst				# database name
+#   tls: disable			# disable, require, verify-ca or verify-full
+#   tlsCA:					# CA certificate file, defaults to the system ones
+#   maxOpenConns: 0			# 0 means unlimited
+#   maxIdleConns: 2
+#   connMaxLifetime: 0		# e.g. 5m, 0 means forever
+#   dsn:					# raw data source name, replaces the settings above
+#   path: /home/user/gohst.db	# used by sqlite
+#   migrate: false			# apply pending migrations when the server starts
+# dbUser:					# used by mysql and postgres
 # dbPass:
 
 ##############################################
 ## 			 server configuration			##
 ##############################################
 # domain: mywebsite.com
-# staticDir: /home/user/gohst-static-files
 # port: 80
 # maxFileSize: 5000000		# bytes, defaults to 5 MB
+# tempDir: /var/tmp			# where uploads are spooled, defaults to the system temp dir
+# expiry:					# e.g. 1h, 7d or 2w, 0 means never
+#   default: 0				# used when an upload doesn't set the expires field
+#   max: 0					# longest expiry an upload may ask for
+# scanInterval: 1h			# how often expired files and leftovers of failed uploads are deleted
+# shutdownGrace: 30s		# how long uploads in progress may take on shutdown, 0 means no limit
+# tokens:					# bearer tokens created by /login
+#   ttl: 30d				# used when a login doesn't set the ttl field, 0 means never
+#   maxTTL: 0				# longest ttl a login may ask for
+# registration:				# self-registration at /api/v1/register
+#   enabled: false			# requires an invite from "gohst invite create"
+# passwords:
+#   minLength: 12			# shortest password users may choose, 8 to 72
+# unlockTTL: 1h				# how long a password protected file stays unlocked
+# signing:					# signed URLs for private files
+#   keys:					# the first key signs, all of them are accepted
+#   - change-me-to-a-long-random-secret
+#   expiry: 1h				# default validity of a signed URL
+#   maxExpiry: 7d
+# tus:						# resumable uploads at /files
+#   dir: /var/tmp/gohst-tus	# where partial uploads are kept
+#   expiry: 24h				# how long an unfinished upload is kept
 # blockedMimeTypes:
 # - application/x-dosexec
-# - application/x-executable`
-
-var dbStructure = `
-USE gohst;
-
-CREATE TABLE users (
-	id int(11) NOT NULL AUTO_INCREMENT,
-	username varchar(255) NOT NULL,
-	password varchar(255) NOT NULL,
-	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
-	PRIMARY KEY(id)
-) ENGINE=InnoDB;
-
-CREATE TABLE auth_tokens (
-	id int(11) NOT NULL AUTO_INCREMENT,
-	account_id int(11) NOT NULL,
-	token varchar(255) NOT NULL,
-	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
-
-	PRIMARY KEY(id),
-	INDEX acc_ind (account_id),
-	FOREIGN KEY (account_id)
-		REFERENCES users(id)
-		ON DELETE CASCADE
-) ENGINE=InnoDB;
-
-CREATE TABLE user_files (
-	id int(11) NOT NULL AUTO_INCREMENT,
-	account_id int(11) NOT NULL,
-	name varchar(255) NOT NULL,
-	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
-
-	PRIMARY KEY(id),
-	INDEX acc_ind (account_id),
-	FOREIGN KEY (account_id)
-		REFERENCES users(id)
-		ON DELETE CASCADE
-) ENGINE=InnoDB;`
+# - application/x-executable
+
+##############################################
+## 			storage configuration			##
+##############################################
+# storage:
+#   backend: local	# local, s3 or memory
+#   s3:				# used by the s3 backend
+#     endpoint: s3.amazonaws.com	# or e.g. localhost:9000 for MinIO
+#     bucket: gohst
+#     region: us-east-1
+#     accessKey:
+#     secretKey:
+#     useSSL: true
+#     pathStyle: false	# required by most MinIO and Garage setups
+#     prefix: ""		# prepended to every object key
+#     presign: 0		# e.g. 15m to redirect public downloads to presigned URLs
+# staticDir: /home/user/gohst-static-files	# used by the local backend`
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+	"github.com/voidiz/gohst/tools"
+	_ "modernc.org/sqlite"
+)
+
+// Database drivers selected by the db.driver setting. SQLite needs no
+// server and keeps the whole instance in a single file at db.path.
+const (
+	driverMySQL    = "mysql"
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+// DB is a database connection that takes queries with ? placeholders for
+// every driver and rebinds them to the placeholders the driver expects.
+// The connection itself isn't exposed, so that no query skips the rebind.
+type DB struct {
+	conn *sqlx.DB
+}
+
+// Tx is a transaction started by DB.Beginx, which rebinds like DB
+type Tx struct {
+	tx *sqlx.Tx
+}
+
+// queryer is implemented by both DB and Tx, for functions that run on their
+// own as well as in a larger transaction
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
+	QueryRowx(query string, args ...interface{}) *sqlx.Row
+	DriverName() string
+}
+
+// openDB connects to the database selected by the db settings in the
+// configuration file. A raw DSN in db.dsn is used as is, instead of the
+// one built from the other settings.
+func openDB() (*DB, error) {
+	driver := viper.GetString("db.driver")
+	dsn := viper.GetString("db.dsn")
+	if dsn == "" {
+		var err error
+		switch driver {
+		case driverMySQL:
+			dsn, err = mysqlDSN(viper.GetString("db.name"))
+		case driverPostgres:
+			dsn = postgresDSN(viper.GetString("db.name"))
+		case driverSQLite:
+			dsn = sqliteDSN()
+		default:
+			return nil, fmt.Errorf("unknown database driver %q", driver)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lifetime, err := tools.ParseDuration(viper.GetString("db.connMaxLifetime"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid db.connMaxLifetime: %v", err)
+	}
+
+	db, err := sqlx.Connect(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(viper.GetInt("db.maxOpenConns"))
+	db.SetMaxIdleConns(viper.GetInt("db.maxIdleConns"))
+	db.SetConnMaxLifetime(lifetime)
+
+	return &DB{db}, nil
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.conn.Exec(db.conn.Rebind(query), args...)
+}
+
+func (db *DB) Get(dest interface{}, query string, args ...interface{}) error {
+	return db.conn.Get(dest, db.conn.Rebind(query), args...)
+}
+
+func (db *DB) Select(dest interface{}, query string, args ...interface{}) error {
+	return db.conn.Select(dest, db.conn.Rebind(query), args...)
+}
+
+func (db *DB) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return db.conn.QueryRowx(db.conn.Rebind(query), args...)
+}
+
+func (db *DB) Beginx() (*Tx, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx}, nil
+}
+
+func (db *DB) DriverName() string {
+	return db.conn.DriverName()
+}
+
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
+
+// inTx runs f in a transaction, which is committed if f succeeds
+func inTx(db *DB, f func(tx *Tx) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.Exec(tx.tx.Rebind(query), args...)
+}
+
+func (tx *Tx) Get(dest interface{}, query string, args ...interface{}) error {
+	return tx.tx.Get(dest, tx.tx.Rebind(query), args...)
+}
+
+func (tx *Tx) Select(dest interface{}, query string, args ...interface{}) error {
+	return tx.tx.Select(dest, tx.tx.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return tx.tx.QueryRowx(tx.tx.Rebind(query), args...)
+}
+
+func (tx *Tx) DriverName() string {
+	return tx.tx.DriverName()
+}
+
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// mysqlDSN returns the data source name of the MySQL database name, or of
+// the server itself if name is empty. Like for Postgres the session runs in
+// UTC, which is also the location times are read and written in.
+func mysqlDSN(name string) (string, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = viper.GetString("dbUser")
+	cfg.Passwd = viper.GetString("dbPass")
+	if socket := viper.GetString("db.socket"); socket != "" {
+		cfg.Net = "unix"
+		cfg.Addr = socket
+	} else {
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(viper.GetString("db.host"), strconv.Itoa(dbPort(3306)))
+	}
+	cfg.DBName = name
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	cfg.Params = map[string]string{"time_zone": "'+00:00'"}
+
+	var err error
+	if cfg.TLSConfig, err = mysqlTLS(); err != nil {
+		return "", err
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// mysqlTLS registers the TLS configuration selected by db.tls and returns
+// its name. The modes are those of Postgres' sslmode.
+func mysqlTLS() (string, error) {
+	switch mode := viper.GetString("db.tls"); mode {
+	case "", "disable":
+		return "false", nil
+	case "require":
+		return "skip-verify", nil
+	case "verify-ca", "verify-full":
+		cfg := &tls.Config{ServerName: viper.GetString("db.host")}
+		if ca := viper.GetString("db.tlsCA"); ca != "" {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return "", err
+			}
+			cfg.RootCAs = x509.NewCertPool()
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return "", fmt.Errorf("no certificates found in %s", ca)
+			}
+		}
+		if mode == "verify-ca" {
+			// Verify the certificate chain but not the host name
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyPeerCertificate = verifyChain(cfg.RootCAs)
+		}
+
+		if err := mysql.RegisterTLSConfig("gohst", cfg); err != nil {
+			return "", err
+		}
+		return "gohst", nil
+	default:
+		return "", fmt.Errorf("unknown db.tls mode %q", mode)
+	}
+}
+
+// verifyChain returns a tls.Config.VerifyPeerCertificate function that
+// checks the certificate chain against roots, or the system roots if nil
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return fmt.Errorf("no server certificate")
+		}
+
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		var leaf *x509.Certificate
+		for i, b := range raw {
+			cert, err := x509.ParseCertificate(b)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				leaf = cert
+			} else {
+				opts.Intermediates.AddCert(cert)
+			}
+		}
+
+		_, err := leaf.Verify(opts)
+		return err
+	}
+}
+
+// postgresDSN returns the data source name of the Postgres database name.
+// The session runs in UTC so that CURRENT_TIMESTAMP matches dbNow.
+func postgresDSN(name string) string {
+	q := url.Values{}
+	q.Set("timezone", "UTC")
+	q.Set("sslmode", viper.GetString("db.tls"))
+	if ca := viper.GetString("db.tlsCA"); ca != "" {
+		q.Set("sslrootcert", ca)
+	}
+
+	host := net.JoinHostPort(viper.GetString("db.host"), strconv.Itoa(dbPort(5432)))
+	if socket := viper.GetString("db.socket"); socket != "" {
+		// Unlike for MySQL this is the directory of the socket, which is
+		// named after the port
+		host = ""
+		q.Set("host", socket)
+		q.Set("port", strconv.Itoa(dbPort(5432)))
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(viper.GetString("dbUser"), viper.GetString("dbPass")),
+		Host:     host,
+		Path:     "/" + name,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// dbPort returns the port set by db.port, or def if there is none
+func dbPort(def int) int {
+	if port := viper.GetInt("db.port"); port > 0 {
+		return port
+	}
+	return def
+}
+
+// sqliteDSN returns the data source name of the SQLite database. Foreign
+// keys are off by default in SQLite, and transactions take the write lock
+// up front so that concurrent ones wait for each other instead of failing.
+func sqliteDSN() string {
+	return viper.GetString("db.path") + "?_pragma=foreign_keys(1)" +
+		"&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)" +
+		"&_txlock=immediate&_time_format=sqlite"
+}
+
+// dropIndexOn matches the table of DROP INDEX, which only MySQL takes
+var dropIndexOn = regexp.MustCompile(`(DROP INDEX \w+) ON \w+`)
+
+// dialect translates schema statements written for MySQL to the dialect of
+// driver. They use {{id}} for the type of an auto-incrementing primary key
+// and end CREATE TABLE with {{table}} for the table options.
+func dialect(driver, query string) string {
+	var r *strings.Replacer
+	switch driver {
+	case driverPostgres:
+		r = strings.NewReplacer(
+			"{{id}}", "SERIAL PRIMARY KEY",
+			"{{table}}", "",
+			"datetime", "timestamp")
+	case driverSQLite:
+		r = strings.NewReplacer(
+			"{{id}}", "INTEGER PRIMARY KEY AUTOINCREMENT",
+			"{{table}}", "")
+	default:
+		r = strings.NewReplacer(
+			"{{id}}", "int NOT NULL AUTO_INCREMENT PRIMARY KEY",
+			"{{table}}", " ENGINE=InnoDB")
+		return r.Replace(query)
+	}
+	return dropIndexOn.ReplaceAllString(r.Replace(query), "$1")
+}
+
+// isDuplicate reports whether err is the violation of a unique index
+func isDuplicate(err error) bool {
+	switch err := err.(type) {
+	case *mysql.MySQLError:
+		return err.Number == 1062
+	case *pq.Error:
+		return err.Code == "23505"
+	}
+	// The SQLite drivers only have the message of SQLite in common
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// dbNow returns the current time for use in queries. Times are stored in
+// UTC, which SQLite relies on since it compares them as text.
+func dbNow() time.Time {
+	return time.Now().UTC()
+}
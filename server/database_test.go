@@ -0,0 +1,337 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/spf13/viper"
+	"github.com/voidiz/gohst/storage"
+)
+
+// forEachDB runs test against every database driver with a migrated
+// database. SQLite runs in a temporary file, Postgres runs if
+// $GOHST_TEST_POSTGRES_DSN is set. The Postgres database is emptied
+// before and after the test, so it mustn't hold anything else.
+func forEachDB(t *testing.T, test func(t *testing.T, e *Env)) {
+	t.Run(driverSQLite, func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "gohst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		runWithDB(t, driverSQLite, "", filepath.Join(dir, "gohst.db"), test)
+	})
+
+	t.Run(driverPostgres, func(t *testing.T) {
+		dsn := os.Getenv("GOHST_TEST_POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("GOHST_TEST_POSTGRES_DSN is not set")
+		}
+		runWithDB(t, driverPostgres, dsn, "", test)
+	})
+}
+
+func runWithDB(t *testing.T, driver, dsn, path string, test func(t *testing.T, e *Env)) {
+	viper.Set("db.driver", driver)
+	viper.Set("db.dsn", dsn)
+	viper.Set("db.path", path)
+	viper.Set("db.connMaxLifetime", "0")
+
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := storage.NewMemory()
+	// Undo whatever an interrupted run left behind
+	if _, err := rollbackDB(db, store, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateDB(db, store); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := rollbackDB(db, store, len(migrations)); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	test(t, &Env{DB: db, Storage: store, TempDir: os.TempDir()})
+}
+
+// rollbackBefore rolls the database back to before the migration named
+// name, so that tests don't depend on the number of later migrations
+func rollbackBefore(t *testing.T, e *Env, name string) {
+	version := 0
+	for _, m := range migrations {
+		if m.Name == name {
+			version = m.Version
+		}
+	}
+	if version == 0 {
+		t.Fatalf("no migration named %q", name)
+	}
+
+	applied, err := appliedMigrations(e.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := 0
+	for v := range applied {
+		if v >= version {
+			steps++
+		}
+	}
+	if _, err := rollbackDB(e.DB, e.Storage, steps); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storeTestFile stores content as an upload by the account with the form
+// fields of an upload
+func storeTestFile(t *testing.T, e *Env, accountID int, name, content string,
+	fields url.Values) (UserFile, error) {
+	f, err := ioutil.TempFile("", "gohst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	up, err := openUpload(f.Name(), name, "", fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.File.Close()
+
+	return e.storeUpload(accountID, nil, up)
+}
+
+func TestMigrations(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		pending, err := pendingMigrations(e.DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) > 0 {
+			t.Fatalf("%d migrations pending after migrating", len(pending))
+		}
+
+		// Every down migration has to undo its up migration for the chain
+		// to apply again
+		done, err := rollbackDB(e.DB, e.Storage, len(migrations))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(done) != len(migrations) {
+			t.Fatalf("rolled back %d of %d migrations", len(done), len(migrations))
+		}
+		var n int
+		if err := e.DB.Get(&n, "SELECT COUNT(*) FROM users"); err == nil {
+			t.Error("users still exists after rolling back every migration")
+		}
+
+		if _, err := migrateDB(e.DB, e.Storage); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMigrationsKeepData(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storeTestFile(t, e, id, "a.txt", "same", nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storeTestFile(t, e, id, "b.txt", "same", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// Back to before blobs, which stores the content under the file
+		// names again
+		rollbackBefore(t, e, "blobs")
+		infos, err := e.Storage.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 2 {
+			t.Fatalf("got %d stored files before blobs, want 2", len(infos))
+		}
+
+		if _, err := migrateDB(e.DB, e.Storage); err != nil {
+			t.Fatal(err)
+		}
+		var refs int
+		if err := e.DB.Get(&refs, "SELECT refs FROM blobs"); err != nil {
+			t.Fatal(err)
+		}
+		if refs != 2 {
+			t.Errorf("got %d references to the shared blob, want 2", refs)
+		}
+		infos, err = e.Storage.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 {
+			t.Errorf("got %d stored files after blobs, want 1", len(infos))
+		}
+	})
+}
+
+func TestQueries(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := insertUser(e.DB, "alice", roleUser, "battery staple"); err != errUsernameTaken {
+			t.Errorf("got %v for a taken username, want %v", err, errUsernameTaken)
+		}
+
+		token, err := e.createAuthToken("alice", "correct horse", "1h")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cred, err := e.findCredential(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.AccountID != id {
+			t.Errorf("token belongs to account %d, want %d", cred.AccountID, id)
+		}
+
+		file, err := storeTestFile(t, e, id, "notes.txt", "hello", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.MimeType != "text/plain" || file.Size != 5 {
+			t.Errorf("stored %s of %d bytes, want text/plain of 5 bytes",
+				file.MimeType, file.Size)
+		}
+
+		fq := fileQuery{Page: 1, PerPage: 10, OrderBy: fileSorts["-created_at"], Type: "text"}
+		files, total, err := e.listFiles(id, fq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(files) != 1 || files[0].Name != file.Name {
+			t.Errorf("listed %d of %d files, want %s", len(files), total, file.Name)
+		}
+
+		one := 1
+		if err := setQuota(e.DB, Quota{AccountID: id, MaxFiles: &one}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storeTestFile(t, e, id, "more.txt", "more", nil); err != errQuotaExceeded {
+			t.Errorf("got %v above the quota, want %v", err, errQuotaExceeded)
+		}
+
+		code, _, err := createInvite(e.DB, &id, roleUser, 1, nil, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := claimInvite(e.DB, code); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := deleteUser(e.DB, e.Storage, "alice"); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if err := e.DB.Get(&n, "SELECT COUNT(*) FROM blobs"); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%d blobs left after deleting their only user", n)
+		}
+	})
+}
+
+// withDBConfig runs test with the database settings in config, resetting
+// them afterwards
+func withDBConfig(config map[string]string, test func()) {
+	defer func() {
+		for key := range config {
+			viper.Set(key, "")
+		}
+	}()
+	for key, value := range config {
+		viper.Set(key, value)
+	}
+	test()
+}
+
+func TestMySQLDSN(t *testing.T) {
+	withDBConfig(map[string]string{
+		"dbUser":  "gohst",
+		"dbPass":  "p@ss:word",
+		"db.host": "db.example.com",
+		"db.port": "3307",
+	}, func() {
+		dsn, err := mysqlDSN("gohst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.User != "gohst" || cfg.Passwd != "p@ss:word" || cfg.Net != "tcp" ||
+			cfg.Addr != "db.example.com:3307" || cfg.DBName != "gohst" {
+			t.Errorf("got %s", dsn)
+		}
+		// Times are stored and read in UTC, whatever the server's zone
+		if !cfg.ParseTime || cfg.Loc != time.UTC || cfg.Params["time_zone"] != "'+00:00'" {
+			t.Errorf("got %s, want times in UTC", dsn)
+		}
+	})
+
+	withDBConfig(map[string]string{"db.socket": "/run/mysqld/mysqld.sock"}, func() {
+		dsn, err := mysqlDSN("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Net != "unix" || cfg.Addr != "/run/mysqld/mysqld.sock" || cfg.DBName != "" {
+			t.Errorf("got %s", dsn)
+		}
+	})
+}
+
+func TestPostgresDSN(t *testing.T) {
+	withDBConfig(map[string]string{
+		"dbUser":  "gohst",
+		"dbPass":  "p@ss:word",
+		"db.host": "db.example.com",
+		"db.tls":  "verify-full",
+	}, func() {
+		u, err := url.Parse(postgresDSN("gohst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pass, _ := u.User.Password()
+		q := u.Query()
+		if u.User.Username() != "gohst" || pass != "p@ss:word" ||
+			u.Host != "db.example.com:5432" || u.Path != "/gohst" ||
+			q.Get("sslmode") != "verify-full" || q.Get("timezone") != "UTC" {
+			t.Errorf("got %s", u)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"log"
+	"net/http"
+)
+
+// apiError is an error that is reported to the client. Code is the
+// machine-readable identifier returned by the JSON API, Message is shown
+// to users and returned as is by the plain text routes.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// Errors reported to clients. The codes are part of the JSON API and must
+// not change, the messages may.
+var (
+	errInternal         = &apiError{http.StatusInternalServerError, "internal_error", "Server error, try again"}
+	errNotFound         = &apiError{http.StatusNotFound, "not_found", "Not found"}
+	errMethodNotAllowed = &apiError{http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed"}
+	errInvalidJSON      = &apiError{http.StatusBadRequest, "invalid_json", "Invalid JSON body"}
+
+	errMissingUser        = &apiError{http.StatusBadRequest, "missing_user", "Missing user value"}
+	errMissingPass        = &apiError{http.StatusBadRequest, "missing_pass", "Missing pass value"}
+	errInvalidCredentials = &apiError{http.StatusUnauthorized, "invalid_credentials", "Invalid username or password"}
+	errAccountSuspended   = &apiError{http.StatusForbidden, "account_suspended", "Account suspended"}
+	errMissingAuthHeader  = &apiError{http.StatusForbidden, "missing_authorization", "Missing authorization header"}
+	errInvalidBearerToken = &apiError{http.StatusForbidden, "invalid_token", "Invalid bearer token"}
+	errNotOwner           = &apiError{http.StatusUnauthorized, "not_owner", "You are not the owner of the file"}
+	errFileNotFound       = &apiError{http.StatusNotFound, "file_not_found", "Invalid filename"}
+	errInvalidTTL         = &apiError{http.StatusBadRequest, "invalid_ttl", "Invalid ttl"}
+	errTokenNotFound      = &apiError{http.StatusNotFound, "token_not_found", "Invalid token ID"}
+	errInsufficientScope  = &apiError{http.StatusForbidden, "insufficient_scope", "Not allowed with this API key"}
+	errKeyNotFound        = &apiError{http.StatusNotFound, "api_key_not_found", "Invalid API key ID"}
+	errMissingKeyName     = &apiError{http.StatusBadRequest, "missing_name", "Missing name value"}
+	errInvalidScopes      = &apiError{http.StatusBadRequest, "invalid_scopes", "Invalid scopes"}
+	errInvalidKeyLimit    = &apiError{http.StatusBadRequest, "invalid_max_file_size", "Invalid max_file_size"}
+	errInvalidMimeTypes   = &apiError{http.StatusBadRequest, "invalid_mime_types", "Invalid mime_types"}
+	errUserNotFound       = &apiError{http.StatusNotFound, "user_not_found", "User does not exist"}
+	errUsernameTaken      = &apiError{http.StatusConflict, "username_taken", "Username already taken!"}
+	errInvalidUsername    = &apiError{http.StatusBadRequest, "invalid_username", "Invalid username"}
+	errInvalidRole        = &apiError{http.StatusBadRequest, "invalid_role", "Invalid role"}
+	errWrongPassword      = &apiError{http.StatusForbidden, "wrong_password", "Wrong password"}
+	errWeakPassword       = &apiError{http.StatusBadRequest, "weak_password",
+		"Password too weak, use a longer one that doesn't contain your username"}
+	errLastAdmin  = &apiError{http.StatusBadRequest, "last_admin", "You are the last admin"}
+	errOwnAccount = &apiError{http.StatusBadRequest, "own_account",
+		"You can't suspend, demote or delete your own account"}
+	errTooManyAttempts = &apiError{http.StatusTooManyRequests, "too_many_attempts",
+		"Too many wrong passwords, try again later"}
+	errAdminOnly      = &apiError{http.StatusForbidden, "admin_only", "Only admins can do this"}
+	errReadOnly       = &apiError{http.StatusForbidden, "read_only", "Read-only accounts can't do this"}
+	errInvalidGrant   = &apiError{http.StatusBadRequest, "invalid_grant", "Invalid grant"}
+	errInvalidIP      = &apiError{http.StatusBadRequest, "invalid_ip", "Invalid IP address"}
+	errInvalidInvite  = &apiError{http.StatusForbidden, "invalid_invite", "Invalid or used up invite"}
+	errInviteNotFound = &apiError{http.StatusNotFound, "invite_not_found", "Invalid invite ID"}
+	errInvalidUses    = &apiError{http.StatusBadRequest, "invalid_uses", "Invalid number of uses"}
+
+	errNoFile             = &apiError{http.StatusBadRequest, "no_file", "No file uploaded"}
+	errFileTooLarge       = &apiError{http.StatusBadRequest, "file_too_large", "File too large!"}
+	errFileBlocked        = &apiError{http.StatusUnsupportedMediaType, "file_type_blocked", "File not allowed!"}
+	errFileTypeNotAllowed = &apiError{http.StatusUnsupportedMediaType, "file_type_not_allowed",
+		"File type not allowed for this API key"}
+	errInvalidExpiry  = &apiError{http.StatusBadRequest, "invalid_expiry", "Invalid expiry"}
+	errInvalidLimit   = &apiError{http.StatusBadRequest, "invalid_download_limit", "Invalid download limit"}
+	errInvalidPrivate = &apiError{http.StatusBadRequest, "invalid_private", "Invalid private value"}
+	errQuotaExceeded  = &apiError{http.StatusForbidden, "quota_exceeded", "Quota exceeded"}
+	errInvalidQuota   = &apiError{http.StatusBadRequest, "invalid_quota", "Invalid quota"}
+
+	errInvalidPage = &apiError{http.StatusBadRequest, "invalid_page", "Invalid page or per_page"}
+	errInvalidSort = &apiError{http.StatusBadRequest, "invalid_sort", "Invalid sort"}
+	errInvalidType = &apiError{http.StatusBadRequest, "invalid_type", "Invalid type filter"}
+	errInvalidDate = &apiError{http.StatusBadRequest, "invalid_date", "Invalid date filter"}
+)
+
+// writeError writes err as a plain text response
+func writeError(w http.ResponseWriter, err error) {
+	if ae, ok := err.(*apiError); ok {
+		http.Error(w, ae.Message, ae.Status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// uploadError writes the response for an error returned while receiving
+// or storing an upload on the plain text routes
+func uploadError(w http.ResponseWriter, err error) {
+	// Kept for compatibility with existing clients
+	if err == errNoFile {
+		http.Error(w, errNoFile.Message, http.StatusOK)
+		return
+	}
+	writeError(w, err)
+}
+
+// writeJSONError writes err in the error envelope of the JSON API. Errors
+// that aren't meant for the client are logged and reported as internal.
+func writeJSONError(w http.ResponseWriter, err error) {
+	ae, ok := err.(*apiError)
+	if !ok {
+		log.Println(err)
+		ae = errInternal
+	}
+
+	writeJSON(w, ae.Status, errorEnvelope{Error: errorBody{
+		Code:    ae.Code,
+		Message: ae.Message,
+	}})
+}
+
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
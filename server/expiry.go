@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/voidiz/gohst/tools"
+)
+
+// uploadExpiry returns when a file uploaded with the supplied expires form
+// field expires, or nil if it never does. An empty field falls back to the
+// default expiry and "0" asks for a file that never expires.
+func (e *Env) uploadExpiry(expires string) (*time.Time, error) {
+	t, ok := expiryTime(expires, e.DefaultExpiry, e.MaxExpiry)
+	if !ok {
+		return nil, errInvalidExpiry
+	}
+	return t, nil
+}
+
+// expiryTime returns the time a duration such as "7d" from now, or nil for
+// "0". An empty value falls back to def and longer durations than max, if
+// set, are rejected. It reports false if value is invalid.
+func expiryTime(value string, def, max time.Duration) (*time.Time, bool) {
+	d := def
+	if value != "" {
+		var err error
+		d, err = tools.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, false
+		}
+	}
+
+	if max > 0 && (d == 0 || d > max) {
+		if value != "" {
+			return nil, false
+		}
+		d = max
+	}
+
+	if d == 0 {
+		return nil, true
+	}
+	t := dbNow().Add(d)
+	return &t, true
+}
+
+// ReapExpiredFiles deletes the files that have expired. A file that can't
+// be deleted is logged and skipped, so that it doesn't hold up the others.
+func (e *Env) ReapExpiredFiles() error {
+	var files []UserFile
+	err := e.DB.Select(&files, `SELECT * FROM user_files
+		WHERE expires_at IS NOT NULL AND expires_at<?`, dbNow())
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range files {
+		removed, err := e.removeFile(file.ID, file.BlobHash)
+		if err != nil {
+			log.Printf("Failed to delete expired file %s: %v\n", file.Name, err)
+			failed++
+			continue
+		}
+
+		if removed {
+			log.Printf("Deleted expired file %s\n", file.Name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d expired files", failed)
+	}
+	return nil
+}
+
+// ReapThrottles forgets the password failures that no longer count
+func (e *Env) ReapThrottles() error {
+	e.unlockThrottle.reap()
+	e.passwordThrottle.reap()
+	return nil
+}
+
+// Reap removes expired files, unfinished uploads, tokens, upload log
+// entries, invites and password failures as well as orphaned blobs
+func (e *Env) Reap() error {
+	return reapAll(
+		e.ReapExpiredFiles,
+		e.ReapBlobs,
+		e.ReapTusUploads,
+		e.ReapExpiredTokens,
+		e.ReapUploadLog,
+		e.ReapInvites,
+		e.ReapThrottles,
+	)
+}
+
+// reapAll runs every reaper, even if one of them fails, and returns their
+// errors as one
+func reapAll(reapers ...func() error) error {
+	var failures []string
+	for _, reap := range reapers {
+		if err := reap(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
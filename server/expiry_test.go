@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/voidiz/gohst/storage"
+)
+
+// failingStorage fails to delete anything
+type failingStorage struct {
+	storage.Storage
+}
+
+func (s failingStorage) Delete(name string) error {
+	return errors.New("storage unavailable")
+}
+
+func TestReapAll(t *testing.T) {
+	var ran []int
+	reaper := func(i int, err error) func() error {
+		return func() error {
+			ran = append(ran, i)
+			return err
+		}
+	}
+
+	err := reapAll(reaper(1, errors.New("first")), reaper(2, nil),
+		reaper(3, errors.New("third")))
+	if len(ran) != 3 {
+		t.Errorf("ran reapers %v, want all three", ran)
+	}
+	if err == nil || err.Error() != "first; third" {
+		t.Errorf("got %v, want the errors of both failing reapers", err)
+	}
+
+	if err := reapAll(reaper(4, nil)); err != nil {
+		t.Errorf("got %v without failures", err)
+	}
+}
+
+func TestReapExpiredFilesContinues(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, content := range []string{"first", "second"} {
+			if _, err := storeTestFile(t, e, id, content+".txt", content, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = e.DB.Exec("UPDATE user_files SET expires_at=?", dbNow().Add(-time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The content is left to ReapBlobs, but the first failure mustn't
+		// keep the second file from expiring
+		e.Storage = failingStorage{e.Storage}
+		if err := e.ReapExpiredFiles(); err == nil {
+			t.Error("failure to delete the content of the files not reported")
+		}
+
+		var n int
+		if err := e.DB.Get(&n, "SELECT COUNT(*) FROM user_files"); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%d expired files left after one failed", n)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errFileGone = errors.New("file no longer available")
+
+// fileJSON is the JSON representation of an uploaded file
+type fileJSON struct {
+	Name              string     `json:"name"`
+	URL               string     `json:"url"`
+	OriginalName      string     `json:"original_name"`
+	Size              int64      `json:"size"`
+	MimeType          string     `json:"mime_type"`
+	SHA256            string     `json:"sha256"`
+	Private           bool       `json:"private"`
+	PasswordProtected bool       `json:"password_protected"`
+	MaxDownloads      *int       `json:"max_downloads"`
+	Downloads         int        `json:"downloads"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+func newFileJSON(r *http.Request, file UserFile) fileJSON {
+	return fileJSON{
+		Name:              file.Name,
+		URL:               fileURL(r, file.Name),
+		OriginalName:      file.OriginalName,
+		Size:              file.Size,
+		MimeType:          file.MimeType,
+		SHA256:            file.BlobHash,
+		Private:           file.Private,
+		PasswordProtected: file.Password != nil,
+		MaxDownloads:      file.MaxDownloads,
+		Downloads:         file.Downloads,
+		ExpiresAt:         file.ExpiresAt,
+		CreatedAt:         file.CreatedAt,
+	}
+}
+
+// mediaType returns a MIME type without its parameters
+func mediaType(mimeType string) string {
+	mt, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	}
+	return mt
+}
+
+// contentType returns the Content-Type header of a file with the supplied
+// MIME type. The charset isn't stored, text is served as UTF-8.
+func contentType(mimeType string) string {
+	if strings.HasPrefix(mimeType, "text/") {
+		return mimeType + "; charset=utf-8"
+	}
+	return mimeType
+}
+
+// removeFile deletes a file record and releases its content. It reports
+// false if the record had already been deleted.
+func (e *Env) removeFile(id int, blobHash string) (bool, error) {
+	var removed bool
+	var key string
+	err := inTx(e.DB, func(tx *Tx) error {
+		res, err := tx.Exec("DELETE FROM user_files WHERE id=?", id)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+
+		removed = true
+		key, err = dropBlobRef(tx, blobHash)
+		return err
+	})
+	if err != nil || !removed {
+		return false, err
+	}
+	return true, deleteContent(e.Storage, key)
+}
+
+// claimDownload counts a download of a file with a download limit. It
+// returns errFileGone once the limit has been reached and reports whether
+// this was the last allowed download, after which the file is removed.
+func (e *Env) claimDownload(id int) (last bool, err error) {
+	for {
+		var file UserFile
+		err := e.DB.Get(&file, `SELECT * FROM user_files
+			WHERE id=? AND (expires_at IS NULL OR expires_at>?)`, id, dbNow())
+		if err != nil {
+			return false, err
+		}
+
+		if file.MaxDownloads == nil {
+			return false, nil
+		}
+		if file.Downloads >= *file.MaxDownloads {
+			return false, errFileGone
+		}
+
+		// Only count the download if nobody else did in the meantime, so
+		// that every download gets a distinct number
+		res, err := e.DB.Exec("UPDATE user_files SET downloads=? WHERE id=? AND downloads=?",
+			file.Downloads+1, id, file.Downloads)
+		if err != nil {
+			return false, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if n == 1 {
+			return file.Downloads+1 == *file.MaxDownloads, nil
+		}
+	}
+}
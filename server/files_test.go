@@ -0,0 +1,124 @@
+package server
+
+import (
+	"database/sql"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestClaimDownloadConcurrent(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := storeTestFile(t, e, id, "a.txt", "hello",
+			url.Values{"downloads": {"3"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Downloads race each other and the owner deleting the file. Every
+		// download gets a distinct number and the file is removed once.
+		var (
+			mu              sync.Mutex
+			claimed, last   int
+			removed         int
+			wg              sync.WaitGroup
+			unexpectedError error
+		)
+		remove := func() {
+			ok, err := e.removeFile(file.ID, file.BlobHash)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				unexpectedError = err
+			}
+			if ok {
+				removed++
+			}
+		}
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				isLast, err := e.claimDownload(file.ID)
+				if err == errFileGone || err == sql.ErrNoRows {
+					return
+				}
+
+				mu.Lock()
+				if err != nil {
+					unexpectedError = err
+				}
+				claimed++
+				if isLast {
+					last++
+				}
+				mu.Unlock()
+
+				if isLast {
+					remove()
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			remove()
+		}()
+		wg.Wait()
+
+		if unexpectedError != nil {
+			t.Fatal(unexpectedError)
+		}
+		if claimed > 3 || last > 1 {
+			t.Errorf("claimed %d downloads of 3, %d of them the last", claimed, last)
+		}
+		if removed != 1 {
+			t.Errorf("file removed %d times, want once", removed)
+		}
+
+		var n int
+		if err := e.DB.Get(&n, "SELECT COUNT(*) FROM blobs"); err != nil {
+			t.Fatal(err)
+		}
+		infos, err := e.Storage.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 || len(infos) != 0 {
+			t.Errorf("%d blobs and %d stored files left after removing the file",
+				n, len(infos))
+		}
+	})
+}
+
+func TestClaimDownloadLimit(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := storeTestFile(t, e, id, "a.txt", "hello",
+			url.Values{"downloads": {"2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, want := range []bool{false, true} {
+			last, err := e.claimDownload(file.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last != want {
+				t.Errorf("download %d: got last %v, want %v", i+1, last, want)
+			}
+		}
+		if _, err := e.claimDownload(file.ID); err != errFileGone {
+			t.Errorf("got %v past the limit, want %v", err, errFileGone)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// The owner of a file can grant other accounts rights on it. The read
+// right lets them see its metadata and sign URLs for it if it is private,
+// the delete right lets them delete it.
+
+const (
+	permRead   = "read"
+	permDelete = "delete"
+)
+
+var permColumns = map[string]string{
+	permRead:   "can_read",
+	permDelete: "can_delete",
+}
+
+// grantJSON is the JSON representation of the rights of an account on a
+// file
+type grantJSON struct {
+	User      string    `db:"username" json:"user"`
+	Read      bool      `db:"can_read" json:"read"`
+	Delete    bool      `db:"can_delete" json:"delete"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// fileAccess returns an unexpired file that the account owns or, unless
+// perm is empty, has been granted perm on
+func (e *Env) fileAccess(accountID int, fileName, perm string) (UserFile, error) {
+	var file UserFile
+	err := e.DB.Get(&file, `SELECT * FROM user_files
+		WHERE name=? AND (expires_at IS NULL OR expires_at>?)`, fileName, dbNow())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return file, errFileNotFound
+		}
+		return file, err
+	}
+
+	if file.AccountID == accountID {
+		return file, nil
+	}
+	if perm == "" {
+		return file, errNotOwner
+	}
+
+	var n int
+	err = e.DB.Get(&n, "SELECT COUNT(*) FROM file_grants WHERE file_id=? AND account_id=? AND "+
+		permColumns[perm]+"=?", file.ID, accountID, true)
+	if err != nil {
+		return file, err
+	}
+	if n == 0 {
+		return file, errNotOwner
+	}
+	return file, nil
+}
+
+// APIListGrants lists the grants on a file owned by the account
+func (e *Env) APIListGrants(w http.ResponseWriter, r *http.Request) {
+	file, err := e.fileAccess(accountID(r), chi.URLParam(r, "filename"), "")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	grants := []grantJSON{}
+	err = e.DB.Select(&grants, `SELECT u.username, g.can_read, g.can_delete, g.created_at
+		FROM file_grants g
+		JOIN users u ON u.id=g.account_id
+		WHERE g.file_id=? ORDER BY u.username`, file.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Grants []grantJSON `json:"grants"`
+	}{grants})
+}
+
+// APIPutGrant sets the rights of an account on a file owned by the
+// account from {"read": true, "delete": false}
+func (e *Env) APIPutGrant(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Read   bool `json:"read"`
+		Delete bool `json:"delete"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if !body.Read && !body.Delete {
+		writeJSONError(w, errInvalidGrant)
+		return
+	}
+
+	file, err := e.fileAccess(accountID(r), chi.URLParam(r, "filename"), "")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	grantee, err := e.grantee(r, file)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = inTx(e.DB, func(tx *Tx) error {
+		_, err := tx.Exec("DELETE FROM file_grants WHERE file_id=? AND account_id=?",
+			file.ID, grantee)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO file_grants (file_id, account_id, can_read, can_delete)
+			VALUES (?, ?, ?, ?)`, file.ID, grantee, body.Read, body.Delete)
+		return err
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIDeleteGrant revokes the rights of an account on a file owned by the
+// account
+func (e *Env) APIDeleteGrant(w http.ResponseWriter, r *http.Request) {
+	file, err := e.fileAccess(accountID(r), chi.URLParam(r, "filename"), "")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	grantee, err := e.grantee(r, file)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	_, err = e.DB.Exec("DELETE FROM file_grants WHERE file_id=? AND account_id=?",
+		file.ID, grantee)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APISharedFiles lists the files other accounts have granted the account
+// rights on
+func (e *Env) APISharedFiles(w http.ResponseWriter, r *http.Request) {
+	var rows []struct {
+		UserFile
+		Owner     string `db:"owner"`
+		CanRead   bool   `db:"can_read"`
+		CanDelete bool   `db:"can_delete"`
+	}
+	err := e.DB.Select(&rows, `SELECT f.*, u.username AS owner, g.can_read, g.can_delete
+		FROM file_grants g
+		JOIN user_files f ON f.id=g.file_id
+		JOIN users u ON u.id=f.account_id
+		WHERE g.account_id=? AND (f.expires_at IS NULL OR f.expires_at>?)
+		ORDER BY f.created_at DESC, f.id DESC`, accountID(r), dbNow())
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	type sharedFileJSON struct {
+		fileJSON
+		Owner  string `json:"owner"`
+		Read   bool   `json:"read"`
+		Delete bool   `json:"delete"`
+	}
+
+	list := make([]sharedFileJSON, len(rows))
+	for i, row := range rows {
+		list[i] = sharedFileJSON{newFileJSON(r, row.UserFile), row.Owner,
+			row.CanRead, row.CanDelete}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Files []sharedFileJSON `json:"files"`
+	}{list})
+}
+
+// grantee returns the ID of the account named in the URL, which can't be
+// the owner of file
+func (e *Env) grantee(r *http.Request, file UserFile) (int, error) {
+	var id int
+	err := e.DB.Get(&id, "SELECT id FROM users WHERE username=?",
+		chi.URLParam(r, "username"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, errUserNotFound
+		}
+		return 0, err
+	}
+
+	if id == file.AccountID {
+		return 0, errInvalidGrant
+	}
+	return id, nil
+}
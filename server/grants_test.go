@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// withCredential returns r as authenticated with cred
+func withCredential(r *http.Request, cred credential) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), credentialKey, cred))
+}
+
+func TestDeleteFileOwnership(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		alice, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := insertUser(e.DB, "bob", roleUser, "battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := storeTestFile(t, e, alice, "a.txt", "hello", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := e.deleteFile(bob, file.Name); err != errNotOwner {
+			t.Errorf("got %v deleting another account's file, want %v", err, errNotOwner)
+		}
+
+		// The read right doesn't allow deleting
+		_, err = e.DB.Exec(`INSERT INTO file_grants (file_id, account_id, can_read)
+			VALUES (?, ?, ?)`, file.ID, bob, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.deleteFile(bob, file.Name); err != errNotOwner {
+			t.Errorf("got %v deleting with the read right, want %v", err, errNotOwner)
+		}
+
+		_, err = e.DB.Exec("UPDATE file_grants SET can_delete=? WHERE file_id=?",
+			true, file.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.deleteFile(bob, file.Name); err != nil {
+			t.Errorf("got %v deleting with the delete right", err)
+		}
+
+		if err := e.deleteFile(alice, file.Name); err != errFileNotFound {
+			t.Errorf("got %v deleting a deleted file, want %v", err, errFileNotFound)
+		}
+	})
+}
+
+func TestAPIPutGrant(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		alice, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := insertUser(e.DB, "bob", roleUser, "battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := storeTestFile(t, e, alice, "a.txt", "hello", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		router := chi.NewRouter()
+		router.Put("/files/{filename}/grants/{username}", e.APIPutGrant)
+		put := func(accountID int, body string) int {
+			r := httptest.NewRequest(http.MethodPut, "/files/"+file.Name+"/grants/bob",
+				strings.NewReader(body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, withCredential(r, credential{AccountID: accountID}))
+			return w.Code
+		}
+
+		if status := put(alice, `{"read": true}`); status != http.StatusNoContent {
+			t.Fatalf("got %d granting read, want %d", status, http.StatusNoContent)
+		}
+		if _, err := e.fileAccess(bob, file.Name, permRead); err != nil {
+			t.Errorf("got %v reading with the read right", err)
+		}
+
+		// A new grant replaces the previous one
+		if status := put(alice, `{"delete": true}`); status != http.StatusNoContent {
+			t.Fatalf("got %d granting delete, want %d", status, http.StatusNoContent)
+		}
+		if _, err := e.fileAccess(bob, file.Name, permRead); err != errNotOwner {
+			t.Errorf("got %v reading after the read right was replaced, want %v",
+				err, errNotOwner)
+		}
+		if _, err := e.fileAccess(bob, file.Name, permDelete); err != nil {
+			t.Errorf("got %v deleting with the delete right", err)
+		}
+
+		// Only the owner can grant rights
+		if status := put(bob, `{"read": true}`); status != errNotOwner.Status {
+			t.Errorf("got %d granting rights on another account's file, want %d",
+				status, errNotOwner.Status)
+		}
+	})
+}
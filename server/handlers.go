@@ -6,215 +6,392 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
+	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/jmoiron/sqlx"
-	"github.com/voidiz/gohst/tools"
+	"github.com/voidiz/gohst/storage"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Env struct {
-	DB               *sqlx.DB
-	StaticDir        string
-	MaxFileSize      int64
-	BlockedMimeTypes []string
+	DB                 *DB
+	Storage            storage.Storage
+	TempDir            string
+	MaxFileSize        int64
+	BlockedMimeTypes   []string
+	DefaultExpiry      time.Duration
+	MaxExpiry          time.Duration
+	SigningKeys        []SigningKey
+	SignedURLExpiry    time.Duration
+	MaxSignedURLExpiry time.Duration
+	TokenTTL           time.Duration
+	MaxTokenTTL        time.Duration
+	MinPasswordLength  int
+	Registration       bool
+	UnlockTTL          time.Duration
+	TusDir             string
+	TusExpiry          time.Duration
+
+	tusBusy          busySet
+	unlockThrottle   throttle
+	passwordThrottle throttle
 }
 
 type contextKey string
 
-const accountIDKey contextKey = "AccountID"
+const credentialKey contextKey = "Credential"
+
+// credential is what a request was authenticated with, either a login
+// token or an API key
+type credential struct {
+	AccountID int
+	Role      string
+	// TokenID is the ID of the login token, 0 for API keys
+	TokenID int
+	Key     *APIKey
+}
+
+// hasScope reports whether the credential grants scope. Login tokens grant
+// every scope, except that read-only accounts can't upload or delete.
+func (c credential) hasScope(scope string) bool {
+	if c.Role == roleReadOnly && (scope == scopeUpload || scope == scopeDelete) {
+		return false
+	}
+	return c.Key == nil || c.Key.hasScope(scope)
+}
 
 func (e *Env) ShowIndex(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("hello!"))
 }
 
 func (e *Env) GetFile(w http.ResponseWriter, r *http.Request) {
-	http.FileServer(http.Dir(e.StaticDir)).ServeHTTP(w, r)
-	// 	http.ServeFile(w, r, fmt.Sprintf("static/%v", chi.URLParam(r, "filename")))
-}
+	fileName := chi.URLParam(r, "filename")
 
-func (e *Env) UploadFile(w http.ResponseWriter, r *http.Request) {
-	file, header, err := r.FormFile("file")
+	var file struct {
+		UserFile
+		StorageKey string `db:"storage_key"`
+	}
+	err := e.DB.QueryRowx(`SELECT f.*, b.storage_key FROM user_files f
+		JOIN blobs b ON b.hash=f.blob_hash
+		WHERE f.name=? AND (f.expires_at IS NULL OR f.expires_at>?)`,
+		fileName, dbNow()).StructScan(&file)
 	if err != nil {
-		switch err.Error() {
-		case "http: no such file":
-			http.Error(w, "No file uploaded", http.StatusOK)
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
 		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
-	if header.Size >= e.MaxFileSize {
-		http.Error(w, "File too large!", http.StatusBadRequest)
+	key := file.StorageKey
+	fi, err := e.Storage.Stat(key)
+	if err != nil {
+		if err == storage.ErrNotExist {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	fi.Name = fileName
 
-	if e.fileBlocked(header.Header.Get("Content-Type")) {
-		http.Error(w, "File not allowed!", http.StatusUnsupportedMediaType)
-		return
+	if file.Private {
+		if !e.validSignature(r, fileName) {
+			http.Error(w, "This file is private", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Cache-Control", "private")
 	}
 
-	fileBytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if file.Password != nil {
+		if !e.fileUnlocked(w, r, fileName, *file.Password) {
+			return
+		}
+		w.Header().Set("Cache-Control", "private")
 	}
 
-	if e.fileBlocked(http.DetectContentType(fileBytes)) {
-		http.Error(w, "File not allowed!", http.StatusUnsupportedMediaType)
-		return
+	limited := file.MaxDownloads != nil
+	if limited && r.Method != http.MethodHead {
+		last, err := e.claimDownload(file.ID)
+		if err != nil {
+			if err == errFileGone || err == sql.ErrNoRows {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if last {
+			defer func() {
+				if _, err := e.removeFile(file.ID, file.BlobHash); err != nil {
+					log.Println(err)
+				}
+			}()
+		}
+
+		// Every counted download gets the whole file
+		r.Header.Del("Range")
 	}
 
-	fileName, err := tools.GenerateFileName(e.DB, fileBytes, header.Filename)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Only set once access has been granted, so that the original name of
+	// a private or password protected file isn't given away. Without a
+	// stored MIME type, the content type is detected from the name.
+	if file.MimeType != "" {
+		w.Header().Set("Content-Type", contentType(file.MimeType))
+	}
+	if file.OriginalName != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline",
+			map[string]string{"filename": file.OriginalName}))
 	}
 
-	f, err := os.Create(filepath.Join(e.StaticDir, fileName))
-	defer f.Close()
+	// Presigned URLs could be reused and would outlive a signature or an
+	// unlock, so limited, private and password protected files are always
+	// streamed
+	if rd, ok := e.Storage.(storage.Redirector); ok && !limited && !file.Private &&
+		file.Password == nil {
+		url, err := rd.URL(key, w.Header().Get("Content-Type"),
+			w.Header().Get("Content-Disposition"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if url != "" {
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+	}
+
+	f, err := e.Storage.Get(key)
 	if err != nil {
+		if err == storage.ErrNotExist {
+			http.NotFound(w, r)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer f.Close()
 
-	if _, err = f.Write(fileBytes); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	serveContent(w, r, fi, f)
+}
+
+func (e *Env) UploadFile(w http.ResponseWriter, r *http.Request) {
+	file, err := e.uploadFile(w, r)
+	if err != nil {
+		uploadError(w, err)
 		return
 	}
 
-	e.DB.MustExec("INSERT INTO user_files (account_id, name) VALUES (?, ?)",
-		r.Context().Value(accountIDKey), fileName)
-
-	var scheme string
-	if r.TLS != nil {
-		scheme = "https"
-	} else {
-		scheme = "http"
+	// Clients asking for JSON get the file's metadata along with the URL
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, newFileJSON(r, file))
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	resp := fmt.Sprintf("%s://%s/%s", scheme, r.Host, fileName)
-	w.Write([]byte(resp))
+	w.Write([]byte(fileURL(r, file.Name)))
 }
 
 func (e *Env) DeleteFile(w http.ResponseWriter, r *http.Request) {
-	var (
-		userCheck string
-		fileCheck string
-		err       error
-	)
 	fileName := chi.URLParam(r, "filename")
 
-	err = e.DB.Get(&userCheck, "SELECT username FROM users WHERE id=?",
-		r.Context().Value(accountIDKey))
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "You are not the owner of the file", http.StatusUnauthorized)
+	if err := e.deleteFile(accountID(r), fileName); err != nil {
+		// Kept for compatibility with existing clients
+		if err == errFileNotFound {
+			http.Error(w, errFileNotFound.Message, http.StatusUnauthorized)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	err = e.DB.Get(&fileCheck, "SELECT name FROM user_files WHERE name=?", fileName)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Successfully deleted " + fileName))
+}
+
+func (e *Env) CreateAuthToken(w http.ResponseWriter, r *http.Request) {
+	token, err := e.createAuthToken(r.PostFormValue("user"), r.PostFormValue("pass"),
+		r.PostFormValue("ttl"))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid filename", http.StatusUnauthorized)
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(token))
+}
+
+func (e *Env) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, err := e.authenticate(r)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+
+		ctx := context.WithValue(r.Context(), credentialKey, cred)
+
+		// Next handler
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// uploadFile receives and stores the file uploaded in r
+func (e *Env) uploadFile(w http.ResponseWriter, r *http.Request) (UserFile, error) {
+	// Refuse uploads that can't fit in the quota before receiving them
+	limit, byQuota, err := e.uploadAllowance(accountID(r), requestCredential(r).Key)
+	if err != nil {
+		return UserFile{}, err
 	}
 
-	_, err = e.DB.Exec("DELETE FROM user_files WHERE name=?",
-		fileName)
+	up, err := receiveUpload(w, r, limit, e.TempDir)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		if err == errFileTooLarge && byQuota {
+			err = errQuotaExceeded
+		}
+		return UserFile{}, err
 	}
+	defer up.Close()
 
-	if err := os.Remove(filepath.Join(e.StaticDir, fileName)); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	return e.storeUpload(accountID(r), requestCredential(r).Key, up)
+}
+
+// deleteFile deletes a file owned by the account, or one it has been
+// granted the delete right on
+func (e *Env) deleteFile(accountID int, fileName string) error {
+	file, err := e.fileAccess(accountID, fileName, permDelete)
+	if err != nil {
+		return err
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Successfully deleted " + fileName))
+	_, err = e.removeFile(file.ID, file.BlobHash)
+	return err
 }
 
-func (e *Env) CreateAuthToken(w http.ResponseWriter, r *http.Request) {
-	formUser := r.PostFormValue("user")
-	if formUser == "" {
-		http.Error(w, "Missing user value", http.StatusBadRequest)
-		return
+// createAuthToken checks the credentials of a user and returns a new
+// bearer token for the account. The token expires after ttl, which works
+// like the expires field of uploads.
+func (e *Env) createAuthToken(username, password, ttl string) (string, error) {
+	if username == "" {
+		return "", errMissingUser
 	}
-	formPass := r.PostFormValue("pass")
-	if formPass == "" {
-		http.Error(w, "Missing pass value", http.StatusBadRequest)
-		return
+	if password == "" {
+		return "", errMissingPass
+	}
+
+	expiresAt, ok := expiryTime(ttl, e.TokenTTL, e.MaxTokenTTL)
+	if !ok {
+		return "", errInvalidTTL
 	}
 
 	var user User
-	err := e.DB.QueryRowx("SELECT * FROM users WHERE username=?", formUser).
+	err := e.DB.QueryRowx("SELECT * FROM users WHERE username=?", username).
 		StructScan(&user)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
-			return
+			return "", errInvalidCredentials
 		}
-		http.Error(w, "Server error, try again", http.StatusInternalServerError)
-		return
+		return "", errInternal
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password),
-		[]byte(formPass)); err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
-		return
+		[]byte(password)); err != nil {
+		return "", errInvalidCredentials
+	}
+	if user.Suspended {
+		return "", errAccountSuspended
 	}
 
-	token, err := generateToken(16)
+	secret, err := generateToken(32)
 	if err != nil {
-		http.Error(w, "Server error, try again", http.StatusInternalServerError)
-		return
+		return "", errInternal
 	}
+	token := authTokenPrefix + secret
 
-	query := "INSERT INTO auth_tokens (account_id, token) VALUES (?, ?)"
-	e.DB.MustExec(query, user.ID, token)
+	_, err = e.DB.Exec(`INSERT INTO auth_tokens (account_id, token_hash, prefix, expires_at)
+		VALUES (?, ?, ?, ?)`, user.ID, hashToken(token), tokenPrefix(token), expiresAt)
+	if err != nil {
+		return "", errInternal
+	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(token))
+	return token, nil
 }
 
-func (e *Env) AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var au AuthToken
+// authenticate looks up the unexpired login token or API key sent in the
+// Authorization header along with the role of its account, which must not
+// be suspended
+func (e *Env) authenticate(r *http.Request) (credential, error) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return credential{}, errMissingAuthHeader
+	}
 
-		token := r.Header.Get("Authorization")
-		if token == "" {
-			http.Error(w, "Missing authorization header", http.StatusForbidden)
-			return
+	cred, err := e.findCredential(strings.TrimPrefix(token, "Bearer "))
+	if err != nil {
+		return cred, err
+	}
+
+	var user User
+	err = e.DB.Get(&user, "SELECT * FROM users WHERE id=?", cred.AccountID)
+	if err != nil {
+		return cred, err
+	}
+	if user.Suspended {
+		return cred, errAccountSuspended
+	}
+	cred.Role = user.Role
+
+	return cred, nil
+}
+
+// findCredential looks up an unexpired login token or API key and records
+// that it was used
+func (e *Env) findCredential(token string) (credential, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		key, err := e.authenticateAPIKey(token)
+		if err == nil {
+			return credential{AccountID: key.AccountID, Key: &key}, nil
+		}
+		// Tokens created by older versions may start with the prefix too
+		if err != errInvalidBearerToken {
+			return credential{}, err
 		}
-		token = strings.TrimLeft(token, "Bearer ")
+	}
 
-		err := e.DB.QueryRowx("SELECT * FROM auth_tokens WHERE token=?", token).StructScan(&au)
-		if err != nil {
-			http.Error(w, "Invalid bearer token", http.StatusForbidden)
-			return
+	var au AuthToken
+	now := dbNow()
+	hash := hashToken(token)
+	err := e.DB.QueryRowx(`SELECT * FROM auth_tokens
+		WHERE token_hash=? AND (expires_at IS NULL OR expires_at>?)`, hash, now).StructScan(&au)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return credential{}, errInvalidBearerToken
 		}
+		return credential{}, err
+	}
 
-		ctx := context.WithValue(r.Context(), accountIDKey, au.AccountID)
+	if err := touch(e.DB, "auth_tokens", au.ID, now); err != nil {
+		return credential{}, err
+	}
 
-		// Next handler
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	return credential{AccountID: au.AccountID, TokenID: au.ID}, nil
+}
+
+// touch sets last_used_at of a token or key. The row is only updated once
+// a minute when it is used in quick succession.
+func touch(db *DB, table string, id int, now time.Time) error {
+	_, err := db.Exec(`UPDATE `+table+` SET last_used_at=?
+		WHERE id=? AND (last_used_at IS NULL OR last_used_at<?)`,
+		now, id, now.Add(-time.Minute))
+	return err
 }
 
 // generateToken generates a bearer token for the authentication system
@@ -226,7 +403,58 @@ func generateToken(size int) (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// requestCredential returns the credential the request was authenticated
+// with by AuthMiddleware
+func requestCredential(r *http.Request) credential {
+	cred, _ := r.Context().Value(credentialKey).(credential)
+	return cred
+}
+
+// accountID returns the ID of the account authenticated by AuthMiddleware
+func accountID(r *http.Request) int {
+	return requestCredential(r).AccountID
+}
+
+// fileURL returns the public URL of an uploaded file
+func fileURL(r *http.Request, fileName string) string {
+	var scheme string
+	if r.TLS != nil {
+		scheme = "https"
+	} else {
+		scheme = "http"
+	}
+
+	return fmt.Sprintf("%s://%s/%s", scheme, r.Host, fileName)
+}
+
+// serveContent writes a stored file to the response. Seekable files go
+// through http.ServeContent so that range and conditional requests work,
+// anything else is streamed as is.
+func serveContent(w http.ResponseWriter, r *http.Request, fi storage.FileInfo,
+	f io.Reader) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, fi.Name, fi.ModTime, rs)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		if ctype := mime.TypeByExtension(filepath.Ext(fi.Name)); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size, 10))
+	if !fi.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", fi.ModTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
+
 func (e *Env) fileBlocked(mimeType string) bool {
+	mimeType = mediaType(mimeType)
 	for _, v := range e.BlockedMimeTypes {
 		if v == mimeType {
 			return true
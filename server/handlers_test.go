@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetFileHidesName(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		e.SigningKeys = []SigningKey{NewSigningKey("secret")}
+		h := testRouter(e)
+
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		private, err := storeTestFile(t, e, id, "secret-plans.txt", "hello",
+			url.Values{"private": {"true"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		protected, err := storeTestFile(t, e, id, "secret-plans.txt", "world",
+			url.Values{"password": {"open sesame"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		withPassword := func(path, password string) *http.Request {
+			r := newRequest(http.MethodGet, path, "", nil)
+			r.Header.Set(filePasswordHeader, password)
+			return r
+		}
+		signed := "/" + private.Name + "?" +
+			e.signQuery(private.Name, time.Now().Add(time.Hour), "").Encode()
+
+		for _, c := range []struct {
+			name   string
+			r      *http.Request
+			status int
+		}{
+			{"private", newRequest(http.MethodGet, "/"+private.Name, "", nil),
+				http.StatusForbidden},
+			{"unlock form", newRequest(http.MethodGet, "/"+protected.Name, "", nil),
+				http.StatusUnauthorized},
+			{"wrong password", withPassword("/"+protected.Name, "guess"),
+				http.StatusUnauthorized},
+		} {
+			w := serve(h, c.r)
+			if w.Code != c.status {
+				t.Errorf("%s: got %d, want %d", c.name, w.Code, c.status)
+			}
+			if cd := w.Header().Get("Content-Disposition"); cd != "" {
+				t.Errorf("%s: got Content-Disposition %q before access was granted",
+					c.name, cd)
+			}
+			if strings.Contains(w.Body.String(), "secret-plans") {
+				t.Errorf("%s: original name in the response", c.name)
+			}
+		}
+
+		for _, r := range []*http.Request{
+			newRequest(http.MethodGet, signed, "", nil),
+			withPassword("/"+protected.Name, "open sesame"),
+		} {
+			w := serve(h, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: got %d, want %d", r.URL, w.Code, http.StatusOK)
+			}
+			if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "secret-plans.txt") {
+				t.Errorf("%s: got Content-Disposition %q with access granted", r.URL, cd)
+			}
+		}
+	})
+}
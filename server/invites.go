@@ -0,0 +1,346 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// When registration is enabled, anyone with an invite code can create an
+// account. The role and quota of the account are taken from the invite.
+// Like tokens, only the SHA-256 of a code is stored.
+
+// invitePrefix starts every invite code
+const invitePrefix = "gi_"
+
+// inviteJSON is the JSON representation of an invite
+type inviteJSON struct {
+	ID        int         `json:"id"`
+	Code      string      `json:"code,omitempty"`
+	Prefix    string      `json:"prefix"`
+	Role      string      `json:"role"`
+	MaxUses   int         `json:"max_uses"`
+	Uses      int         `json:"uses"`
+	Quota     quotaLimits `json:"quota"`
+	ExpiresAt *time.Time  `json:"expires_at"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+func newInviteJSON(inv Invite) inviteJSON {
+	return inviteJSON{
+		ID:        inv.ID,
+		Prefix:    inv.Prefix,
+		Role:      inv.Role,
+		MaxUses:   inv.MaxUses,
+		Uses:      inv.Uses,
+		Quota:     newQuotaLimits(inv.quota(0)),
+		ExpiresAt: inv.ExpiresAt,
+		CreatedAt: inv.CreatedAt,
+	}
+}
+
+// quota returns the quota an account created with the invite gets
+func (inv Invite) quota(accountID int) Quota {
+	return Quota{
+		AccountID:     accountID,
+		MaxBytes:      inv.MaxBytes,
+		MaxFiles:      inv.MaxFiles,
+		MaxFileSize:   inv.MaxFileSize,
+		MaxDailyBytes: inv.MaxDailyBytes,
+	}
+}
+
+// limited reports whether the quota has any limits
+func (q Quota) limited() bool {
+	return q.MaxBytes != nil || q.MaxFiles != nil || q.MaxFileSize != nil ||
+		q.MaxDailyBytes != nil
+}
+
+// APIRegister creates an account from {"invite": ..., "username": ...,
+// "password": ...}
+func (e *Env) APIRegister(w http.ResponseWriter, r *http.Request) {
+	if !e.Registration {
+		writeJSONError(w, errNotFound)
+		return
+	}
+
+	var body struct {
+		Invite   string `json:"invite"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !validUsername(body.Username) {
+		writeJSONError(w, errInvalidUsername)
+		return
+	}
+	if !e.strongPassword(body.Password, body.Username) {
+		writeJSONError(w, errWeakPassword)
+		return
+	}
+
+	// The invite is only used up if the account is created
+	err := inTx(e.DB, func(tx *Tx) error {
+		inv, err := claimInvite(tx, body.Invite)
+		if err != nil {
+			return err
+		}
+
+		id, err := insertUser(tx, body.Username, inv.Role, body.Password)
+		if err != nil {
+			return err
+		}
+		if q := inv.quota(id); q.limited() {
+			return replaceQuota(tx, q)
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := e.findUser(body.Username)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newUserJSON(user))
+}
+
+func (e *Env) APIAdminListInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := listInvites(e.DB)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	list := make([]inviteJSON, len(invites))
+	for i, inv := range invites {
+		list[i] = newInviteJSON(inv)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Invites []inviteJSON `json:"invites"`
+	}{list})
+}
+
+// APIAdminCreateInvite creates an invite from {"uses": ..., "expires": ...,
+// "role": ..., "quota": {...}} and returns it along with its code
+func (e *Env) APIAdminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Uses    int         `json:"uses"`
+		Expires string      `json:"expires"`
+		Role    string      `json:"role"`
+		Quota   quotaLimits `json:"quota"`
+	}{Uses: 1, Role: roleUser}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	expiresAt, ok := expiryTime(body.Expires, 0, 0)
+	if !ok {
+		writeJSONError(w, errInvalidExpiry)
+		return
+	}
+	if !body.Quota.valid() {
+		writeJSONError(w, errInvalidQuota)
+		return
+	}
+
+	id := accountID(r)
+	code, inv, err := createInvite(e.DB, &id, body.Role, body.Uses, expiresAt,
+		body.Quota.quota(0))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	res := newInviteJSON(inv)
+	res.Code = code
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func (e *Env) APIAdminRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, errInviteNotFound)
+		return
+	}
+
+	if err := revokeInvite(e.DB, id); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createInvite creates an invite that can be used uses times and returns
+// its code
+func createInvite(db *DB, createdBy *int, role string, uses int,
+	expiresAt *time.Time, q Quota) (string, Invite, error) {
+	var inv Invite
+	if !validRole(role) {
+		return "", inv, errInvalidRole
+	}
+	if uses < 1 {
+		return "", inv, errInvalidUses
+	}
+
+	secret, err := generateToken(16)
+	if err != nil {
+		return "", inv, err
+	}
+	code := invitePrefix + secret
+
+	_, err = db.Exec(`INSERT INTO invites
+		(code_hash, prefix, role, max_uses, max_bytes, max_files, max_file_size,
+		max_daily_bytes, expires_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(code), tokenPrefix(code), role, uses, q.MaxBytes, q.MaxFiles,
+		q.MaxFileSize, q.MaxDailyBytes, expiresAt, createdBy)
+	if err != nil {
+		return "", inv, err
+	}
+
+	err = db.Get(&inv, "SELECT * FROM invites WHERE code_hash=?", hashToken(code))
+	return code, inv, err
+}
+
+// claimInvite uses up one use of an unexpired invite
+func claimInvite(db queryer, code string) (Invite, error) {
+	var inv Invite
+	hash := hashToken(code)
+	err := db.Get(&inv, `SELECT * FROM invites
+		WHERE code_hash=? AND (expires_at IS NULL OR expires_at>?)`, hash, dbNow())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return inv, errInvalidInvite
+		}
+		return inv, err
+	}
+
+	res, err := db.Exec("UPDATE invites SET uses=uses+1 WHERE id=? AND uses<max_uses",
+		inv.ID)
+	if err != nil {
+		return inv, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return inv, err
+	}
+	if n == 0 {
+		return inv, errInvalidInvite
+	}
+	return inv, nil
+}
+
+func listInvites(db *DB) ([]Invite, error) {
+	invites := []Invite{}
+	err := db.Select(&invites, `SELECT * FROM invites
+		WHERE uses<max_uses AND (expires_at IS NULL OR expires_at>?)
+		ORDER BY id`, dbNow())
+	return invites, err
+}
+
+func revokeInvite(db *DB, id int) error {
+	res, err := db.Exec("DELETE FROM invites WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errInviteNotFound
+	}
+	return nil
+}
+
+// ReapInvites deletes the invites that have expired or been used up
+func (e *Env) ReapInvites() error {
+	_, err := e.DB.Exec(`DELETE FROM invites
+		WHERE uses>=max_uses OR (expires_at IS NOT NULL AND expires_at<?)`, dbNow())
+	return err
+}
+
+// CreateInvite creates an invite and prints its code. The quota limits
+// are parsed by parseQuotaLimits.
+func CreateInvite(uses int, expires, role string, maxBytes, maxFiles, maxFileSize,
+	maxDailyBytes *string) {
+	db := Initialize()
+
+	expiresAt, ok := expiryTime(expires, 0, 0)
+	if !ok {
+		fmt.Printf("Invalid expiry %q\n", expires)
+		os.Exit(1)
+	}
+
+	var q Quota
+	if err := parseQuotaLimits(&q, maxBytes, maxFiles, maxFileSize, maxDailyBytes); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	code, inv, err := createInvite(db, nil, role, uses, expiresAt, q)
+	if err != nil {
+		if ae, ok := err.(*apiError); ok {
+			fmt.Println(ae.Message)
+			os.Exit(1)
+		}
+		panic(err)
+	}
+
+	fmt.Printf("Created invite %d for %d account(s), expires %s.\nCode:\n%s\n",
+		inv.ID, uses, formatTime(inv.ExpiresAt), code)
+}
+
+// ListInvites prints the invites that can still be used
+func ListInvites() {
+	db := Initialize()
+
+	invites, err := listInvites(db)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(invites) == 0 {
+		fmt.Println("No invites.")
+		return
+	}
+
+	fmt.Printf("%-8s %-12s %-10s %-8s %s\n", "ID", "PREFIX", "ROLE", "USES", "EXPIRES")
+	for _, inv := range invites {
+		fmt.Printf("%-8d %-12s %-10s %-8s %s\n", inv.ID, inv.Prefix, inv.Role,
+			fmt.Sprintf("%d/%d", inv.Uses, inv.MaxUses), formatTime(inv.ExpiresAt))
+	}
+}
+
+// RevokeInvite deletes an invite
+func RevokeInvite(id int) {
+	db := Initialize()
+
+	if err := revokeInvite(db, id); err != nil {
+		if err == errInviteNotFound {
+			fmt.Printf("Invite %d does not exist!\n", id)
+			os.Exit(1)
+		}
+		panic(err)
+	}
+	fmt.Printf("Revoked invite %d!\n", id)
+}
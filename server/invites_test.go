@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// register sends a registration request and returns the response status
+func register(e *Env, invite, username, password string) int {
+	body, _ := json.Marshal(map[string]string{
+		"invite":   invite,
+		"username": username,
+		"password": password,
+	})
+	w := httptest.NewRecorder()
+	e.APIRegister(w, httptest.NewRequest(http.MethodPost, "/api/register",
+		strings.NewReader(string(body))))
+	return w.Code
+}
+
+func TestInviteUses(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		e.Registration = true
+		e.MinPasswordLength = minPasswordLength
+
+		code, _, err := createInvite(e.DB, nil, roleUser, 2, nil, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"alice", "bob"} {
+			if status := register(e, code, name, "correct horse"); status != http.StatusCreated {
+				t.Fatalf("registering %s: got %d, want %d", name, status, http.StatusCreated)
+			}
+		}
+		if status := register(e, code, "carol", "correct horse"); status != errInvalidInvite.Status {
+			t.Errorf("got %d with a used up invite, want %d", status, errInvalidInvite.Status)
+		}
+
+		invites, err := listInvites(e.DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(invites) != 0 {
+			t.Errorf("used up invite still listed")
+		}
+	})
+}
+
+func TestInviteFailedRegistration(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		e.Registration = true
+		e.MinPasswordLength = minPasswordLength
+
+		if _, err := insertUser(e.DB, "alice", roleUser, "correct horse"); err != nil {
+			t.Fatal(err)
+		}
+		code, _, err := createInvite(e.DB, nil, roleUser, 1, nil, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A taken username doesn't use up the invite
+		if status := register(e, code, "alice", "correct horse"); status != errUsernameTaken.Status {
+			t.Fatalf("got %d for a taken username, want %d", status, errUsernameTaken.Status)
+		}
+		var uses int
+		if err := e.DB.Get(&uses, "SELECT uses FROM invites"); err != nil {
+			t.Fatal(err)
+		}
+		if uses != 0 {
+			t.Errorf("failed registration used the invite %d times", uses)
+		}
+
+		if status := register(e, code, "bob", "correct horse"); status != http.StatusCreated {
+			t.Errorf("got %d, want %d", status, http.StatusCreated)
+		}
+	})
+}
+
+func TestClaimInviteConcurrent(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		code, _, err := createInvite(e.DB, nil, roleUser, 3, nil, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			mu      sync.Mutex
+			claimed int
+			wg      sync.WaitGroup
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := claimInvite(e.DB, code)
+				if err == errInvalidInvite {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				claimed++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		if claimed != 3 {
+			t.Errorf("invite with 3 uses claimed %d times", claimed)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 200
+	dateLayout     = "2006-01-02"
+)
+
+// fileSorts maps the accepted sort parameters to ORDER BY clauses. A
+// leading "-" sorts in descending order.
+var fileSorts = map[string]string{
+	"created_at":     "created_at ASC, id ASC",
+	"-created_at":    "created_at DESC, id DESC",
+	"name":           "name ASC",
+	"-name":          "name DESC",
+	"original_name":  "original_name ASC, id ASC",
+	"-original_name": "original_name DESC, id DESC",
+	"size":           "size ASC, id ASC",
+	"-size":          "size DESC, id DESC",
+}
+
+// fileQuery selects a page of the files of an account
+type fileQuery struct {
+	Page    int
+	PerPage int
+	OrderBy string
+	Type    string
+	Since   *time.Time
+	Until   *time.Time
+}
+
+// parseFileQuery reads a fileQuery from the page, per_page, sort, type,
+// since and until query parameters. Type is either a full MIME type such as
+// "image/png" or a top-level type such as "image".
+func parseFileQuery(q url.Values) (fileQuery, error) {
+	fq := fileQuery{Page: 1, PerPage: defaultPerPage, OrderBy: fileSorts["-created_at"]}
+
+	var err error
+	if v := q.Get("page"); v != "" {
+		if fq.Page, err = strconv.Atoi(v); err != nil || fq.Page < 1 {
+			return fq, errInvalidPage
+		}
+	}
+	if v := q.Get("per_page"); v != "" {
+		fq.PerPage, err = strconv.Atoi(v)
+		if err != nil || fq.PerPage < 1 || fq.PerPage > maxPerPage {
+			return fq, errInvalidPage
+		}
+	}
+
+	if v := q.Get("sort"); v != "" {
+		orderBy, ok := fileSorts[v]
+		if !ok {
+			return fq, errInvalidSort
+		}
+		fq.OrderBy = orderBy
+	}
+
+	if v := q.Get("type"); v != "" {
+		if !validTypeFilter(v) {
+			return fq, errInvalidType
+		}
+		fq.Type = strings.ToLower(v)
+	}
+
+	for _, p := range []struct {
+		key string
+		t   **time.Time
+	}{{"since", &fq.Since}, {"until", &fq.Until}} {
+		v := q.Get(p.key)
+		if v == "" {
+			continue
+		}
+		t, err := parseDate(v)
+		if err != nil {
+			return fq, errInvalidDate
+		}
+		// A date without a time includes the whole day
+		if p.key == "until" && len(v) == len(dateLayout) {
+			t = t.AddDate(0, 0, 1)
+		}
+		*p.t = &t
+	}
+
+	return fq, nil
+}
+
+// listFiles returns a page of the unexpired files of an account along with
+// the total number of files matching the query
+func (e *Env) listFiles(accountID int, fq fileQuery) ([]UserFile, int, error) {
+	where := "account_id=? AND (expires_at IS NULL OR expires_at>?)"
+	args := []interface{}{accountID, dbNow()}
+
+	if fq.Type != "" {
+		if strings.Contains(fq.Type, "/") {
+			where += " AND mime_type=?"
+			args = append(args, fq.Type)
+		} else {
+			where += " AND mime_type LIKE ?"
+			args = append(args, fq.Type+"/%")
+		}
+	}
+	if fq.Since != nil {
+		where += " AND created_at>=?"
+		args = append(args, *fq.Since)
+	}
+	if fq.Until != nil {
+		where += " AND created_at<?"
+		args = append(args, *fq.Until)
+	}
+
+	var total int
+	if err := e.DB.Get(&total, "SELECT COUNT(*) FROM user_files WHERE "+where,
+		args...); err != nil {
+		return nil, 0, err
+	}
+
+	files := []UserFile{}
+	err := e.DB.Select(&files, "SELECT * FROM user_files WHERE "+where+
+		" ORDER BY "+fq.OrderBy+" LIMIT ? OFFSET ?",
+		append(args, fq.PerPage, (fq.Page-1)*fq.PerPage)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return files, total, nil
+}
+
+// validTypeFilter reports whether t looks like a MIME type or a top-level
+// type, so that it can't carry LIKE wildcards
+func validTypeFilter(t string) bool {
+	parts := strings.Split(t, "/")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || strings.ContainsRune("+-.", c)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseDate parses an RFC 3339 timestamp or a date such as 2020-01-31
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(dateLayout, s)
+}
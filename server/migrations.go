@@ -0,0 +1,685 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/voidiz/gohst/storage"
+)
+
+// The schema is changed through numbered migrations, which are applied in
+// order and recorded in the schema_migrations table. Every migration can
+// be rolled back by its down statements. The statements are written for
+// MySQL and translated to the other drivers by dialect, so they have to
+// stick to what all of them support: one change per ALTER TABLE, a default
+// for every new NOT NULL column and indexes created on their own.
+//
+// New migrations are appended to migrations. Once released, a migration
+// must not change.
+
+// migration is a numbered change to the schema. UpData and DownData carry
+// the existing data along, UpData after the Up statements and DownData
+// before the Down statements, in the same transaction.
+type migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	UpData   dataStep
+	DownData dataStep
+}
+
+// dataStep moves the data of a migration. It returns the storage keys it
+// no longer needs, which are deleted once the migration is committed.
+type dataStep func(tx *Tx, store storage.Storage) (stale []string, err error)
+
+var migrations = []migration{
+	{Version: 1, Name: "initial schema", Up: initialSchema, Down: `
+DROP TABLE user_files;
+DROP TABLE auth_tokens;
+DROP TABLE users;`},
+
+	{Version: 2, Name: "resumable uploads", Up: `
+CREATE TABLE tus_uploads (
+	id varchar(64) NOT NULL,
+	account_id int NOT NULL,
+	upload_length bigint NOT NULL,
+	received bigint NOT NULL DEFAULT 0,
+	metadata text NOT NULL,
+	expires_at datetime NOT NULL,
+	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+	PRIMARY KEY(id),
+	FOREIGN KEY (account_id)
+		REFERENCES users(id)
+		ON DELETE CASCADE
+){{table}};
+
+CREATE INDEX tus_acc_ind ON tus_uploads (account_id);`, Down: `
+DROP TABLE tus_uploads;`},
+
+	{Version: 3, Name: "blobs", Up: `
+CREATE TABLE blobs (
+	hash char(64) NOT NULL,
+	storage_key varchar(255) NOT NULL,
+	size bigint NOT NULL,
+	refs int NOT NULL DEFAULT 0,
+	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+	PRIMARY KEY(hash)
+){{table}};
+
+ALTER TABLE user_files ADD COLUMN blob_hash char(64) NOT NULL DEFAULT '';
+CREATE INDEX blob_ind ON user_files (blob_hash);`,
+		UpData: storeFilesAsBlobs, DownData: storeBlobsAsFiles, Down: `
+DROP INDEX blob_ind ON user_files;
+ALTER TABLE user_files DROP COLUMN blob_hash;
+DROP TABLE blobs;`},
+
+	{Version: 4, Name: "file expiry", Up: `
+ALTER TABLE user_files ADD COLUMN expires_at datetime NULL;
+CREATE INDEX expires_ind ON user_files (expires_at);`, Down: `
+DROP INDEX expires_ind ON user_files;
+ALTER TABLE user_files DROP COLUMN expires_at;`},
+
+	{Version: 5, Name: "download limits", Up: `
+ALTER TABLE user_files ADD COLUMN max_downloads int NULL;
+ALTER TABLE user_files ADD COLUMN downloads int NOT NULL DEFAULT 0;`, Down: `
+ALTER TABLE user_files DROP COLUMN downloads;
+ALTER TABLE user_files DROP COLUMN max_downloads;`},
+
+	{Version: 6, Name: "file passwords", Up: `
+ALTER TABLE user_files ADD COLUMN password varchar(255) NULL;`, Down: `
+ALTER TABLE user_files DROP COLUMN password;`},
+
+	{Version: 7, Name: "private files", Up: `
+ALTER TABLE user_files ADD COLUMN private boolean NOT NULL DEFAULT FALSE;`, Down: `
+ALTER TABLE user_files DROP COLUMN private;`},
+
+	// Older files get the size of their blob. Their MIME type is left empty,
+	// which GetFile detects from the name.
+	{Version: 8, Name: "file metadata", Up: `
+ALTER TABLE user_files ADD COLUMN original_name varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE user_files ADD COLUMN size bigint NOT NULL DEFAULT 0;
+ALTER TABLE user_files ADD COLUMN mime_type varchar(255) NOT NULL DEFAULT '';
+UPDATE user_files SET size=COALESCE((SELECT b.size FROM blobs b WHERE b.hash=user_files.blob_hash), 0);
+CREATE UNIQUE INDEX name_ind ON user_files (name);`, Down: `
+DROP INDEX name_ind ON user_files;
+ALTER TABLE user_files DROP COLUMN mime_type;
+ALTER TABLE user_files DROP COLUMN size;
+ALTER TABLE user_files DROP COLUMN original_name;`},
+
+	{Version: 9, Name: "token expiry", Up: `
+ALTER TABLE auth_tokens ADD COLUMN expires_at datetime NULL;
+ALTER TABLE auth_tokens ADD COLUMN last_used_at datetime NULL;
+CREATE UNIQUE INDEX token_ind ON auth_tokens (token);`, Down: `
+DROP INDEX token_ind ON auth_tokens;
+ALTER TABLE auth_tokens DROP COLUMN last_used_at;
+ALTER TABLE auth_tokens DROP COLUMN expires_at;`},
+
+	{Version: 10, Name: "api keys", Up: `
+CREATE TABLE api_keys (
+	id {{id}},
+	account_id int NOT NULL,
+	name varchar(255) NOT NULL,
+	prefix varchar(16) NOT NULL,
+	key_hash char(64) NOT NULL,
+	scopes varchar(255) NOT NULL,
+	max_file_size bigint NULL,
+	mime_types text NOT NULL,
+	expires_at datetime NULL,
+	last_used_at datetime NULL,
+	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+	FOREIGN KEY (account_id)
+		REFERENCES users(id)
+		ON DELETE CASCADE
+){{table}};
+
+CREATE UNIQUE INDEX key_ind ON api_keys (key_hash);
+CREATE INDEX key_acc_ind ON api_keys (account_id);`, Down: `
+DROP TABLE api_keys;`},
+
+	{Version: 11, Name: "hashed tokens", Up: `
+ALTER TABLE auth_tokens ADD COLUMN token_hash char(64) NOT NULL DEFAULT '';
+ALTER TABLE auth_tokens ADD COLUMN prefix varchar(16) NOT NULL DEFAULT '';`,
+		UpData: hashStoredTokens, Down: `
+ALTER TABLE auth_tokens DROP COLUMN prefix;
+ALTER TABLE auth_tokens DROP COLUMN token_hash;`},
+
+	// The raw tokens can't be recovered from their hashes, so rolling this
+	// back signs everyone out
+	{Version: 12, Name: "drop raw tokens", Up: `
+DROP INDEX token_ind ON auth_tokens;
+ALTER TABLE auth_tokens DROP COLUMN token;
+CREATE UNIQUE INDEX token_ind ON auth_tokens (token_hash);`, Down: `
+DROP INDEX token_ind ON auth_tokens;
+DELETE FROM auth_tokens;
+ALTER TABLE auth_tokens ADD COLUMN token varchar(255) NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX token_ind ON auth_tokens (token);`},
+
+	{Version: 13, Name: "file grants", Up: `
+CREATE TABLE file_grants (
+	id {{id}},
+	file_id int NOT NULL,
+	account_id int NOT NULL,
+	can_read boolean NOT NULL DEFAULT FALSE,
+	can_delete boolean NOT NULL DEFAULT FALSE,
+	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+	FOREIGN KEY (file_id)
+		REFERENCES user_files(id)
+		ON DELETE CASCADE,
+	FOREIGN KEY (account_id)
+		REFERENCES users(id)
+		ON DELETE CASCADE
+){{table}};
+
+CREATE UNIQUE INDEX file_acc_ind ON file_grants (file_id, account_id);
+CREATE INDEX grant_acc_ind ON file_grants (account_id);`, Down: `
+DROP TABLE file_grants;`},
+
+	{Version: 14, Name: "account roles", Up: `
+ALTER TABLE users ADD COLUMN role varchar(16) NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN suspended boolean NOT NULL DEFAULT FALSE;
+CREATE UNIQUE INDEX username_ind ON users (username);`, Down: `
+DROP INDEX username_ind ON users;
+ALTER TABLE users DROP COLUMN suspended;
+ALTER TABLE users DROP COLUMN role;`},
+
+	{Version: 15, Name: "quotas", Up: `
+CREATE TABLE quotas (
+	account_id int NOT NULL,
+	max_bytes bigint NULL,
+	max_files int NULL,
+	max_file_size bigint NULL,
+	max_daily_bytes bigint NULL,
+
+	PRIMARY KEY(account_id),
+	FOREIGN KEY (account_id)
+		REFERENCES users(id)
+		ON DELETE CASCADE
+){{table}};
+
+CREATE TABLE upload_log (
+	id {{id}},
+	account_id int NOT NULL,
+	size bigint NOT NULL,
+	created_at datetime NOT NULL,
+
+	FOREIGN KEY (account_id)
+		REFERENCES users(id)
+		ON DELETE CASCADE
+){{table}};
+
+CREATE INDEX acc_created_ind ON upload_log (account_id, created_at);
+CREATE INDEX created_ind ON upload_log (created_at);`, Down: `
+DROP TABLE upload_log;
+DROP TABLE quotas;`},
+
+	{Version: 16, Name: "invites", Up: `
+CREATE TABLE invites (
+	id {{id}},
+	code_hash char(64) NOT NULL,
+	prefix varchar(16) NOT NULL,
+	role varchar(16) NOT NULL,
+	max_uses int NOT NULL,
+	uses int NOT NULL DEFAULT 0,
+	max_bytes bigint NULL,
+	max_files int NULL,
+	max_file_size bigint NULL,
+	max_daily_bytes bigint NULL,
+	expires_at datetime NULL,
+	created_by int NULL,
+	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+	FOREIGN KEY (created_by)
+		REFERENCES users(id)
+		ON DELETE SET NULL
+){{table}};
+
+CREATE UNIQUE INDEX code_ind ON invites (code_hash);`, Down: `
+DROP TABLE invites;`},
+}
+
+const migrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version int NOT NULL,
+	name varchar(255) NOT NULL,
+	applied_at datetime NOT NULL,
+
+	PRIMARY KEY(version)
+){{table}}`
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	Version   int       `db:"version"`
+	Name      string    `db:"name"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+// appliedMigrations returns the applied migrations by version, creating
+// schema_migrations first if needed
+func appliedMigrations(db *DB) (map[int]appliedMigration, error) {
+	if _, err := db.Exec(dialect(db.DriverName(), migrationsTable)); err != nil {
+		return nil, err
+	}
+
+	var rows []appliedMigration
+	if err := db.Select(&rows, "SELECT * FROM schema_migrations"); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]appliedMigration)
+	for _, m := range rows {
+		applied[m.Version] = m
+	}
+	return applied, nil
+}
+
+// pendingMigrations returns the migrations that haven't been applied yet
+func pendingMigrations(db *DB) ([]migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrateDB applies the pending migrations and returns them
+func migrateDB(db *DB, store storage.Storage) ([]migration, error) {
+	if err := baselineLegacyDB(db); err != nil {
+		return nil, err
+	}
+
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range pending {
+		err := runMigration(db, store, m.Up, m.UpData, nil, func(tx *Tx) error {
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at)
+				VALUES (?, ?, ?)`, m.Version, m.Name, dbNow())
+			return err
+		})
+		if err != nil {
+			return pending[:i], fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+// rollbackDB rolls back the last steps applied migrations and returns them
+func rollbackDB(db *DB, store storage.Storage, steps int) ([]migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		err := runMigration(db, store, m.Down, nil, m.DownData, func(tx *Tx) error {
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version=?", m.Version)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// runMigration runs before, the statements, after and record in one
+// transaction, then deletes the storage keys the data steps left stale.
+// MySQL commits implicitly after every schema change, so a failed
+// migration may be left half applied there.
+func runMigration(db *DB, store storage.Storage, statements string,
+	after, before dataStep, record func(tx *Tx) error) error {
+	var stale []string
+	err := inTx(db, func(tx *Tx) error {
+		if before != nil {
+			keys, err := before(tx, store)
+			if err != nil {
+				return err
+			}
+			stale = append(stale, keys...)
+		}
+
+		for _, s := range splitStatements(dialect(db.DriverName(), statements)) {
+			if _, err := tx.Exec(s); err != nil {
+				return err
+			}
+		}
+
+		if after != nil {
+			keys, err := after(tx, store)
+			if err != nil {
+				return err
+			}
+			stale = append(stale, keys...)
+		}
+		return record(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range stale {
+		if err := store.Delete(key); err != nil && err != storage.ErrNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitStatements splits a script into its statements, which are run one
+// at a time since not every driver accepts several in one query. The
+// statements of the migrations don't contain semicolons otherwise.
+func splitStatements(script string) []string {
+	var statements []string
+	for _, s := range strings.Split(script, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			statements = append(statements, s)
+		}
+	}
+	return statements
+}
+
+// baselineLegacyDB records the initial schema as applied on a database that
+// was created before migrations existed, which only MySQL could be. The
+// later migrations then bring it up to date like any other database.
+func baselineLegacyDB(db *DB) error {
+	if db.DriverName() != driverMySQL {
+		return nil
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil || len(applied) > 0 {
+		return err
+	}
+
+	var n int
+	err = db.Get(&n, `SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema=DATABASE() AND table_name='users'`)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	m := migrations[0]
+	_, err = db.Exec(`INSERT INTO schema_migrations (version, name, applied_at)
+		VALUES (?, ?, ?)`, m.Version, m.Name, dbNow())
+	return err
+}
+
+// hashStoredTokens stores the hashes of the raw tokens in
+// auth_tokens.token, so that they keep working once the raw tokens are
+// dropped
+func hashStoredTokens(tx *Tx, _ storage.Storage) ([]string, error) {
+	var tokens []struct {
+		ID    int
+		Token string
+	}
+	if err := tx.Select(&tokens, "SELECT id, token FROM auth_tokens"); err != nil {
+		return nil, err
+	}
+
+	for _, au := range tokens {
+		// Older tokens have less entropy, so less of them is kept in the clear
+		prefix := au.Token
+		if len(prefix) > 4 {
+			prefix = prefix[:4]
+		}
+
+		_, err := tx.Exec("UPDATE auth_tokens SET token_hash=?, prefix=? WHERE id=?",
+			hashToken(au.Token), prefix, au.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// storeFilesAsBlobs moves the files that older versions stored under their
+// names into blobs. Files that are missing from the storage are left
+// without a blob and can't be downloaded, like before.
+func storeFilesAsBlobs(tx *Tx, store storage.Storage) ([]string, error) {
+	var files []struct {
+		ID   int
+		Name string
+	}
+	if err := tx.Select(&files, "SELECT id, name FROM user_files"); err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for _, f := range files {
+		hash, size, err := hashStored(store, f.Name)
+		if err != nil {
+			if err == storage.ErrNotExist {
+				log.Printf("File %s is missing from the storage\n", f.Name)
+				continue
+			}
+			return nil, err
+		}
+
+		ok, err := refBlob(tx, hash)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			key, err := blobKey(hash)
+			if err != nil {
+				return nil, err
+			}
+			if err := copyStored(store, f.Name, key); err != nil {
+				return nil, err
+			}
+
+			_, err = tx.Exec("INSERT INTO blobs (hash, storage_key, size, refs) VALUES (?, ?, ?, 1)",
+				hash, key, size)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = tx.Exec("UPDATE user_files SET blob_hash=? WHERE id=?", hash, f.ID)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, f.Name)
+	}
+	return stale, nil
+}
+
+// storeBlobsAsFiles stores every file under its name again, for the
+// versions from before blobs
+func storeBlobsAsFiles(tx *Tx, store storage.Storage) ([]string, error) {
+	var files []struct {
+		Name       string
+		StorageKey string `db:"storage_key"`
+	}
+	err := tx.Select(&files, `SELECT f.name, b.storage_key FROM user_files f
+		JOIN blobs b ON b.hash=f.blob_hash`)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if err := copyStored(store, f.StorageKey, f.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+	err = tx.Select(&keys, "SELECT storage_key FROM blobs")
+	return keys, err
+}
+
+// hashStored returns the hex encoded SHA-256 and the size of a stored file
+func hashStored(store storage.Storage, name string) (string, int64, error) {
+	f, err := store.Get(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// copyStored copies the stored file from to the name to
+func copyStored(store storage.Storage, from, to string) error {
+	f, err := store.Get(from)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return store.Put(to, f)
+}
+
+// Migrate applies the pending migrations
+func Migrate() {
+	db, err := openDB()
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	store, err := NewStorage()
+	if err != nil {
+		panic(err)
+	}
+
+	done, err := migrateDB(db, store)
+	for _, m := range done {
+		fmt.Printf("Applied migration %d (%s)\n", m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(done) == 0 {
+		fmt.Println("The database is up to date.")
+	}
+}
+
+// MigrationStatus prints every migration and when it was applied
+func MigrationStatus() {
+	db, err := openDB()
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("%-8s %-24s %s\n", "VERSION", "NAME", "APPLIED")
+	for _, m := range migrations {
+		status := "pending"
+		if a, ok := applied[m.Version]; ok {
+			status = formatTime(&a.AppliedAt)
+		}
+		fmt.Printf("%-8d %-24s %s\n", m.Version, m.Name, status)
+	}
+}
+
+// Rollback rolls back the last steps applied migrations once the user has
+// confirmed it
+func Rollback(steps int) {
+	if steps < 1 {
+		fmt.Println("Nothing to roll back.")
+		return
+	}
+	if !confirmAction("Rolling back migrations may delete data, continue?") {
+		fmt.Println("Aborting...")
+		os.Exit(1)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	store, err := NewStorage()
+	if err != nil {
+		panic(err)
+	}
+
+	done, err := rollbackDB(db, store, steps)
+	for _, m := range done {
+		fmt.Printf("Rolled back migration %d (%s)\n", m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(done) == 0 {
+		fmt.Println("Nothing to roll back.")
+	}
+}
+
+// initialSchema is the schema created by the setup of the first version,
+// before migrations existed. Index names are unique across tables as
+// SQLite and Postgres require, databases of that version use acc_ind for
+// both indexes instead.
+const initialSchema = `
+CREATE TABLE users (
+	id {{id}},
+	username varchar(255) NOT NULL,
+	password varchar(255) NOT NULL,
+	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+){{table}};
+
+CREATE TABLE auth_tokens (
+	id {{id}},
+	account_id int NOT NULL,
+	token varchar(255) NOT NULL,
+	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+	FOREIGN KEY (account_id)
+		REFERENCES users(id)
+		ON DELETE CASCADE
+){{table}};
+
+CREATE INDEX token_acc_ind ON auth_tokens (account_id);
+
+CREATE TABLE user_files (
+	id {{id}},
+	account_id int NOT NULL,
+	name varchar(255) NOT NULL,
+	created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+	FOREIGN KEY (account_id)
+		REFERENCES users(id)
+		ON DELETE CASCADE
+){{table}};
+
+CREATE INDEX file_owner_ind ON user_files (account_id);`
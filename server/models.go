@@ -6,19 +6,98 @@ type User struct {
 	ID        int
 	Username  string
 	Password  string
+	Role      string
+	Suspended bool
 	CreatedAt time.Time `db:"created_at"`
 }
 
 type AuthToken struct {
-	ID        int
-	AccountID int `db:"account_id"`
-	Token     string
-	CreatedAt time.Time `db:"created_at"`
+	ID         int
+	AccountID  int    `db:"account_id"`
+	TokenHash  string `db:"token_hash"`
+	Prefix     string
+	ExpiresAt  *time.Time `db:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+type Quota struct {
+	AccountID     int    `db:"account_id"`
+	MaxBytes      *int64 `db:"max_bytes"`
+	MaxFiles      *int   `db:"max_files"`
+	MaxFileSize   *int64 `db:"max_file_size"`
+	MaxDailyBytes *int64 `db:"max_daily_bytes"`
+}
+
+type Invite struct {
+	ID            int
+	CodeHash      string `db:"code_hash"`
+	Prefix        string
+	Role          string
+	MaxUses       int `db:"max_uses"`
+	Uses          int
+	MaxBytes      *int64     `db:"max_bytes"`
+	MaxFiles      *int       `db:"max_files"`
+	MaxFileSize   *int64     `db:"max_file_size"`
+	MaxDailyBytes *int64     `db:"max_daily_bytes"`
+	ExpiresAt     *time.Time `db:"expires_at"`
+	CreatedBy     *int       `db:"created_by"`
+	CreatedAt     time.Time  `db:"created_at"`
+}
+
+type APIKey struct {
+	ID          int
+	AccountID   int `db:"account_id"`
+	Name        string
+	Prefix      string
+	KeyHash     string `db:"key_hash"`
+	Scopes      string
+	MaxFileSize *int64     `db:"max_file_size"`
+	MimeTypes   string     `db:"mime_types"`
+	ExpiresAt   *time.Time `db:"expires_at"`
+	LastUsedAt  *time.Time `db:"last_used_at"`
+	CreatedAt   time.Time  `db:"created_at"`
 }
 
 type UserFile struct {
+	ID           int
+	AccountID    int `db:"account_id"`
+	Name         string
+	OriginalName string `db:"original_name"`
+	Size         int64
+	MimeType     string     `db:"mime_type"`
+	BlobHash     string     `db:"blob_hash"`
+	ExpiresAt    *time.Time `db:"expires_at"`
+	MaxDownloads *int       `db:"max_downloads"`
+	Downloads    int
+	Password     *string
+	Private      bool
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+type FileGrant struct {
 	ID        int
-	AccountID int `db:"account_id"`
-	Name      string
+	FileID    int       `db:"file_id"`
+	AccountID int       `db:"account_id"`
+	CanRead   bool      `db:"can_read"`
+	CanDelete bool      `db:"can_delete"`
 	CreatedAt time.Time `db:"created_at"`
 }
+
+type Blob struct {
+	Hash       string
+	StorageKey string `db:"storage_key"`
+	Size       int64
+	Refs       int
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type TusUpload struct {
+	ID           string
+	AccountID    int   `db:"account_id"`
+	UploadLength int64 `db:"upload_length"`
+	Received     int64
+	Metadata     string
+	ExpiresAt    time.Time `db:"expires_at"`
+	CreatedAt    time.Time `db:"created_at"`
+}
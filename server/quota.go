@@ -0,0 +1,381 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/voidiz/gohst/tools"
+)
+
+// Accounts can be limited in the total size and number of their files, the
+// size of a single file and the volume they upload in 24 hours. Accounts
+// without a row in quotas are unlimited, as is every nil limit.
+//
+// Sizes count the files of the account even if their content is shared
+// with other files. The upload volume is tracked in upload_log, so that
+// deleting files doesn't reset it.
+
+// quotaUsage is what an account has used of its quota
+type quotaUsage struct {
+	Bytes      int64 `json:"bytes"`
+	Files      int   `json:"files"`
+	DailyBytes int64 `json:"daily_bytes"`
+}
+
+// quotaLimits is the JSON representation of the limits of a quota
+type quotaLimits struct {
+	MaxBytes      *int64 `json:"max_bytes"`
+	MaxFiles      *int   `json:"max_files"`
+	MaxFileSize   *int64 `json:"max_file_size"`
+	MaxDailyBytes *int64 `json:"max_daily_bytes"`
+}
+
+// quotaJSON is the JSON representation of the quota of an account
+type quotaJSON struct {
+	Limits quotaLimits `json:"limits"`
+	Usage  quotaUsage  `json:"usage"`
+}
+
+func (l quotaLimits) valid() bool {
+	for _, n := range []*int64{l.MaxBytes, l.MaxFileSize, l.MaxDailyBytes} {
+		if n != nil && *n < 0 {
+			return false
+		}
+	}
+	return l.MaxFiles == nil || *l.MaxFiles >= 0
+}
+
+func (l quotaLimits) quota(accountID int) Quota {
+	return Quota{
+		AccountID:     accountID,
+		MaxBytes:      l.MaxBytes,
+		MaxFiles:      l.MaxFiles,
+		MaxFileSize:   l.MaxFileSize,
+		MaxDailyBytes: l.MaxDailyBytes,
+	}
+}
+
+func accountQuota(db queryer, accountID int) (Quota, error) {
+	var quotas []Quota
+	err := db.Select(&quotas, "SELECT * FROM quotas WHERE account_id=?", accountID)
+	if err != nil || len(quotas) == 0 {
+		return Quota{AccountID: accountID}, err
+	}
+	return quotas[0], nil
+}
+
+func accountUsage(db queryer, accountID int) (quotaUsage, error) {
+	var u quotaUsage
+	err := db.QueryRowx(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM user_files
+		WHERE account_id=?`, accountID).Scan(&u.Files, &u.Bytes)
+	if err != nil {
+		return u, err
+	}
+
+	err = db.Get(&u.DailyBytes, `SELECT COALESCE(SUM(size), 0) FROM upload_log
+		WHERE account_id=? AND created_at>?`, accountID, dbNow().Add(-24*time.Hour))
+	return u, err
+}
+
+// remaining returns how many more bytes the account may store in a single
+// file, or -1 if its quota doesn't limit that. It returns
+// errQuotaExceeded if the account can't store any more files.
+func (q Quota) remaining(u quotaUsage) (int64, error) {
+	if q.MaxFiles != nil && u.Files >= *q.MaxFiles {
+		return 0, errQuotaExceeded
+	}
+
+	left := int64(-1)
+	limit := func(n int64) {
+		if left < 0 || n < left {
+			left = n
+		}
+	}
+	if q.MaxFileSize != nil {
+		limit(*q.MaxFileSize)
+	}
+	if q.MaxBytes != nil {
+		limit(*q.MaxBytes - u.Bytes)
+	}
+	if q.MaxDailyBytes != nil {
+		limit(*q.MaxDailyBytes - u.DailyBytes)
+	}
+
+	if left == 0 || left < -1 {
+		return 0, errQuotaExceeded
+	}
+	return left, nil
+}
+
+// uploadAllowance returns the size an upload by the account has to stay
+// below, taking its quota and the API key into account, and whether the
+// limit comes from the quota
+func (e *Env) uploadAllowance(accountID int, key *APIKey) (int64, bool, error) {
+	limit := e.uploadLimit(key)
+
+	q, err := accountQuota(e.DB, accountID)
+	if err != nil {
+		return 0, false, err
+	}
+	u, err := accountUsage(e.DB, accountID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	left, err := q.remaining(u)
+	if err != nil || left < 0 || left >= limit {
+		return limit, false, err
+	}
+	return left + 1, true, nil
+}
+
+// checkQuota returns errQuotaExceeded if storing a file of size would
+// exceed the quota of the account. It only holds until the file is
+// stored if db is a transaction that locked the account with lockAccount.
+func checkQuota(db queryer, accountID int, size int64) error {
+	q, err := accountQuota(db, accountID)
+	if err != nil {
+		return err
+	}
+	u, err := accountUsage(db, accountID)
+	if err != nil {
+		return err
+	}
+
+	left, err := q.remaining(u)
+	if err != nil {
+		return err
+	}
+	if left >= 0 && size > left {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// lockAccount locks the row of the account until the end of tx, so that
+// concurrent uploads by the account check its quota one after the other.
+// SQLite has no row locks, but its transactions already lock the whole
+// database up front.
+func lockAccount(tx *Tx, accountID int) error {
+	if tx.DriverName() == driverSQLite {
+		return nil
+	}
+	var id int
+	return tx.Get(&id, "SELECT id FROM users WHERE id=? FOR UPDATE", accountID)
+}
+
+// logUpload records an upload towards the daily upload volume
+func logUpload(db queryer, accountID int, size int64) error {
+	_, err := db.Exec("INSERT INTO upload_log (account_id, size, created_at) VALUES (?, ?, ?)",
+		accountID, size, dbNow())
+	return err
+}
+
+// ReapUploadLog forgets the uploads that no longer count towards the daily
+// upload volume
+func (e *Env) ReapUploadLog() error {
+	_, err := e.DB.Exec("DELETE FROM upload_log WHERE created_at<?",
+		dbNow().Add(-24*time.Hour))
+	return err
+}
+
+func setQuota(db *DB, q Quota) error {
+	return inTx(db, func(tx *Tx) error {
+		return replaceQuota(tx, q)
+	})
+}
+
+// replaceQuota replaces the quota of an account as part of a transaction
+func replaceQuota(tx *Tx, q Quota) error {
+	if _, err := tx.Exec("DELETE FROM quotas WHERE account_id=?", q.AccountID); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`INSERT INTO quotas
+		(account_id, max_bytes, max_files, max_file_size, max_daily_bytes)
+		VALUES (?, ?, ?, ?, ?)`,
+		q.AccountID, q.MaxBytes, q.MaxFiles, q.MaxFileSize, q.MaxDailyBytes)
+	return err
+}
+
+func newQuotaJSON(db *DB, accountID int) (quotaJSON, error) {
+	var res quotaJSON
+
+	q, err := accountQuota(db, accountID)
+	if err != nil {
+		return res, err
+	}
+	res.Limits = newQuotaLimits(q)
+
+	res.Usage, err = accountUsage(db, accountID)
+	return res, err
+}
+
+// APIGetQuota returns the quota of the account and how much of it is used
+func (e *Env) APIGetQuota(w http.ResponseWriter, r *http.Request) {
+	res, err := newQuotaJSON(e.DB, accountID(r))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (e *Env) APIAdminGetQuota(w http.ResponseWriter, r *http.Request) {
+	user, err := e.findUser(chi.URLParam(r, "username"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	res, err := newQuotaJSON(e.DB, user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// APIAdminSetQuota replaces the quota of an account with {"max_bytes": ...,
+// "max_files": ..., "max_file_size": ..., "max_daily_bytes": ...}, where
+// missing or null limits are unlimited
+func (e *Env) APIAdminSetQuota(w http.ResponseWriter, r *http.Request) {
+	var limits quotaLimits
+	if err := decodeJSON(r, &limits); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if !limits.valid() {
+		writeJSONError(w, errInvalidQuota)
+		return
+	}
+
+	user, err := e.findUser(chi.URLParam(r, "username"))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if err := setQuota(e.DB, limits.quota(user.ID)); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	res, err := newQuotaJSON(e.DB, user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// ShowQuota prints the quota of the supplied username and its usage
+func ShowQuota(user string) {
+	db := Initialize()
+
+	res, err := newQuotaJSON(db, accountByName(db, user))
+	if err != nil {
+		panic(err)
+	}
+
+	l, u := res.Limits, res.Usage
+	fmt.Printf("Quota of \"%s\":\n", user)
+	fmt.Printf("  total size:   %d / %s\n", u.Bytes, formatLimit(l.MaxBytes))
+	fmt.Printf("  files:        %d / %s\n", u.Files, formatLimit(intLimit(l.MaxFiles)))
+	fmt.Printf("  file size:    %s\n", formatLimit(l.MaxFileSize))
+	fmt.Printf("  last 24h:     %d / %s\n", u.DailyBytes, formatLimit(l.MaxDailyBytes))
+}
+
+// SetQuota changes the quota of the supplied username, see
+// parseQuotaLimits for the format of the limits
+func SetQuota(user string, maxBytes, maxFiles, maxFileSize, maxDailyBytes *string) {
+	db := Initialize()
+
+	q, err := accountQuota(db, accountByName(db, user))
+	if err != nil {
+		panic(err)
+	}
+
+	if err := parseQuotaLimits(&q, maxBytes, maxFiles, maxFileSize, maxDailyBytes); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := setQuota(db, q); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Updated the quota of \"%s\"!\n", user)
+}
+
+// parseQuotaLimits sets the limits of q from command line values. Nil
+// limits are left as they are and "unlimited" removes a limit. Sizes are
+// parsed by tools.ParseSize.
+func parseQuotaLimits(q *Quota, maxBytes, maxFiles, maxFileSize, maxDailyBytes *string) error {
+	for _, l := range []struct {
+		name  string
+		value *string
+		limit **int64
+	}{
+		{"bytes", maxBytes, &q.MaxBytes},
+		{"file-size", maxFileSize, &q.MaxFileSize},
+		{"daily", maxDailyBytes, &q.MaxDailyBytes},
+	} {
+		if l.value == nil {
+			continue
+		}
+		if *l.value == "unlimited" {
+			*l.limit = nil
+			continue
+		}
+
+		n, err := tools.ParseSize(*l.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", l.name, err)
+		}
+		*l.limit = &n
+	}
+
+	if maxFiles != nil {
+		if *maxFiles == "unlimited" {
+			q.MaxFiles = nil
+		} else {
+			n, err := strconv.Atoi(*maxFiles)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid files: %q", *maxFiles)
+			}
+			q.MaxFiles = &n
+		}
+	}
+	return nil
+}
+
+func newQuotaLimits(q Quota) quotaLimits {
+	return quotaLimits{
+		MaxBytes:      q.MaxBytes,
+		MaxFiles:      q.MaxFiles,
+		MaxFileSize:   q.MaxFileSize,
+		MaxDailyBytes: q.MaxDailyBytes,
+	}
+}
+
+func formatLimit(n *int64) string {
+	if n == nil {
+		return "unlimited"
+	}
+	return strconv.FormatInt(*n, 10)
+}
+
+func intLimit(n *int) *int64 {
+	if n == nil {
+		return nil
+	}
+	v := int64(*n)
+	return &v
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+// routes registers the handlers of e on the router
+func (s *Server) routes(e *Env) {
+	scoped := func(scope string) func(http.Handler) http.Handler {
+		return requireScope(scope, writeError)
+	}
+
+	s.Router.Use(middleware.StripSlashes)
+	s.Router.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(30 * time.Second))
+
+		// Public routes
+		r.Get("/", e.ShowIndex)
+		r.Get("/{filename:\\w+.\\w+}", e.GetFile)
+		r.Post("/{filename:\\w+.\\w+}", e.UnlockFile)
+		r.Post("/login", e.CreateAuthToken)
+
+		// Protected routes
+		r.Group(func(r chi.Router) {
+			r.Use(e.AuthMiddleware)
+			r.With(scoped(scopeDelete)).Delete("/{filename:\\w+.\\w+}", e.DeleteFile)
+			r.With(scoped(scopeList)).Post("/sign/{filename:\\w+.\\w+}", e.SignFile)
+			r.Post("/logout", e.Logout)
+		})
+	})
+
+	// Uploads are streamed and may take longer than the timeout above
+	s.Router.Group(func(r chi.Router) {
+		r.Use(e.AuthMiddleware)
+		r.Use(scoped(scopeUpload))
+		r.Post("/", e.UploadFile)
+
+		// Resumable uploads
+		r.Route("/files", func(r chi.Router) {
+			r.Use(e.TusMiddleware)
+			r.Options("/", e.TusOptions)
+			r.Post("/", e.TusCreate)
+			r.Head("/{id}", e.TusHead)
+			r.Patch("/{id}", e.TusPatch)
+			r.Delete("/{id}", e.TusDelete)
+		})
+	})
+
+	s.Router.Route("/api/v1", e.apiRoutes)
+}
+
+// apiRoutes registers the handlers of the JSON API
+func (e *Env) apiRoutes(r chi.Router) {
+	scoped := func(scope string) func(http.Handler) http.Handler {
+		return requireScope(scope, writeJSONError)
+	}
+	writable := denyReadOnly(writeJSONError)
+
+	r.NotFound(e.APINotFound)
+	r.MethodNotAllowed(e.APIMethodNotAllowed)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(30 * time.Second))
+		r.Post("/auth/tokens", e.APICreateToken)
+		r.Post("/register", e.APIRegister)
+
+		r.Group(func(r chi.Router) {
+			r.Use(e.APIAuthMiddleware)
+			r.Post("/auth/logout", e.APILogout)
+
+			r.Group(func(r chi.Router) {
+				r.Use(scoped(scopeAdmin))
+				r.Get("/account", e.APIGetAccount)
+				r.Put("/account/password", e.APIChangePassword)
+				r.Put("/account/username", e.APIChangeUsername)
+				r.Delete("/account", e.APIDeleteAccount)
+				r.Get("/auth/tokens", e.APIListTokens)
+				r.Delete("/auth/tokens/{id:\\d+}", e.APIRevokeToken)
+				r.Get("/auth/keys", e.APIListKeys)
+				r.With(writable).Post("/auth/keys", e.APICreateKey)
+				r.Delete("/auth/keys/{id:\\d+}", e.APIRevokeKey)
+				r.Get("/files/{filename:\\w+.\\w+}/grants", e.APIListGrants)
+				r.With(writable).Put("/files/{filename:\\w+.\\w+}/grants/{username}", e.APIPutGrant)
+				r.With(writable).Delete("/files/{filename:\\w+.\\w+}/grants/{username}", e.APIDeleteGrant)
+			})
+
+			r.Route("/admin/invites", func(r chi.Router) {
+				r.Use(e.RequireAdmin)
+				r.Get("/", e.APIAdminListInvites)
+				r.Post("/", e.APIAdminCreateInvite)
+				r.Delete("/{id:\\d+}", e.APIAdminRevokeInvite)
+			})
+
+			r.Route("/admin/users", func(r chi.Router) {
+				r.Use(e.RequireAdmin)
+				r.Get("/", e.APIAdminListUsers)
+				r.Post("/", e.APIAdminCreateUser)
+				r.Get("/{username}", e.APIAdminGetUser)
+				r.Patch("/{username}", e.APIAdminUpdateUser)
+				r.Delete("/{username}", e.APIAdminDeleteUser)
+				r.Post("/{username}/password", e.APIAdminResetPassword)
+				r.Get("/{username}/files", e.APIAdminListFiles)
+				r.Get("/{username}/quota", e.APIAdminGetQuota)
+				r.Put("/{username}/quota", e.APIAdminSetQuota)
+			})
+
+			r.With(scoped(scopeList)).Get("/quota", e.APIGetQuota)
+			r.With(scoped(scopeList)).Get("/files", e.APIListFiles)
+			r.With(scoped(scopeList)).Get("/shared", e.APISharedFiles)
+			r.With(scoped(scopeList)).Get("/files/{filename:\\w+.\\w+}", e.APIGetFile)
+			r.With(scoped(scopeDelete)).Delete("/files/{filename:\\w+.\\w+}", e.APIDeleteFile)
+			r.With(scoped(scopeList)).Post("/files/{filename:\\w+.\\w+}/signed-urls", e.APISignFile)
+		})
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(e.APIAuthMiddleware)
+		r.Use(scoped(scopeUpload))
+		r.Post("/files", e.APIUploadFile)
+	})
+}
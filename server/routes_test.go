@@ -0,0 +1,48 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// testRouter returns the routes of the server for e
+func testRouter(e *Env) http.Handler {
+	s := &Server{Router: chi.NewRouter()}
+	s.routes(e)
+	return s.Router
+}
+
+// loginTestUser creates an account and returns its ID along with a login
+// token for it
+func loginTestUser(t *testing.T, e *Env, username, role string) (int, string) {
+	id, err := insertUser(e.DB, username, role, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := e.createAuthToken(username, "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, token
+}
+
+// newRequest returns a request authenticated with token, unless it is
+// empty
+func newRequest(method, path, token string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, path, body)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// serve sends r through h and returns the response
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Endpoints that let users manage their own account. Every change needs the
+// current password, so that a stolen token isn't enough to take over or
+// delete an account.
+
+// APIGetAccount returns the account the request is made by
+func (e *Env) APIGetAccount(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := e.DB.Get(&user, "SELECT * FROM users WHERE id=?", accountID(r)); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
+
+// APIChangePassword changes the password of the account with
+// {"current": ..., "new": ...} and revokes its other login tokens
+func (e *Env) APIChangePassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Current string `json:"current"`
+		New     string `json:"new"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := e.checkPassword(accountID(r), body.Current)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !e.strongPassword(body.New, user.Username) || body.New == body.Current {
+		writeJSONError(w, errWeakPassword)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(body.New), bcrypt.DefaultCost)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	_, err = e.DB.Exec("UPDATE users SET password=? WHERE id=?", hashed, user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	_, err = e.DB.Exec("DELETE FROM auth_tokens WHERE account_id=? AND id<>?",
+		user.ID, requestCredential(r).TokenID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIChangeUsername renames the account with {"username": ..., "password": ...}
+func (e *Env) APIChangeUsername(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := e.checkPassword(accountID(r), body.Password)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if !validUsername(body.Username) {
+		writeJSONError(w, errInvalidUsername)
+		return
+	}
+
+	var n int
+	err = e.DB.Get(&n, "SELECT COUNT(*) FROM users WHERE username=? AND id<>?",
+		body.Username, user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if n > 0 {
+		writeJSONError(w, errUsernameTaken)
+		return
+	}
+
+	_, err = e.DB.Exec("UPDATE users SET username=? WHERE id=?", body.Username, user.ID)
+	if err != nil {
+		// Taken since the check above
+		if isDuplicate(err) {
+			err = errUsernameTaken
+		}
+		writeJSONError(w, err)
+		return
+	}
+
+	user.Username = body.Username
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
+
+// APIDeleteAccount deletes the account along with its files after
+// checking {"password": ...}
+func (e *Env) APIDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := e.checkPassword(accountID(r), body.Password)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	// Keep the server manageable
+	if user.Role == roleAdmin {
+		var admins int
+		err := e.DB.Get(&admins, "SELECT COUNT(*) FROM users WHERE role=? AND suspended=?",
+			roleAdmin, false)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		if admins <= 1 {
+			writeJSONError(w, errLastAdmin)
+			return
+		}
+	}
+
+	if err := deleteUser(e.DB, e.Storage, user.Username); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkPassword returns the account if password is its current password.
+// The attempts are throttled per account, so that a stolen token can't be
+// used to find out the password.
+func (e *Env) checkPassword(accountID int, password string) (User, error) {
+	var user User
+	if err := e.DB.Get(&user, "SELECT * FROM users WHERE id=?", accountID); err != nil {
+		return user, err
+	}
+
+	key := strconv.Itoa(accountID)
+	if !e.passwordThrottle.attempt(key) {
+		return user, errTooManyAttempts
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return user, errWrongPassword
+	}
+	e.passwordThrottle.succeed(key)
+	return user, nil
+}
+
+// Bounds of passwords.minLength. Shorter passwords are too easy to guess
+// and bcrypt doesn't take passwords longer than 72 bytes.
+const (
+	minPasswordLength    = 8
+	maxMinPasswordLength = 72
+)
+
+// clampInt returns n limited to the range from min to max
+func clampInt(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// strongPassword reports whether password satisfies the password policy:
+// it has to be at least MinPasswordLength characters long and must not
+// contain the username
+func (e *Env) strongPassword(password, username string) bool {
+	if len([]rune(password)) < e.MinPasswordLength {
+		return false
+	}
+	return !strings.Contains(strings.ToLower(password), strings.ToLower(username))
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChangePassword(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		e.MinPasswordLength = minPasswordLength
+		h := testRouter(e)
+		_, token := loginTestUser(t, e, "alice", roleUser)
+		other, err := e.createAuthToken("alice", "correct horse", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		change := func(body string) int {
+			return serve(h, newRequest(http.MethodPut, "/api/v1/account/password", token,
+				strings.NewReader(body))).Code
+		}
+		for _, c := range []struct {
+			body   string
+			status int
+		}{
+			{`{"current": "wrong horse", "new": "battery staple"}`, errWrongPassword.Status},
+			{`{"current": "correct horse", "new": "short"}`, errWeakPassword.Status},
+			{`{"current": "correct horse", "new": "alice's staple"}`, errWeakPassword.Status},
+			{`{"current": "correct horse", "new": "correct horse"}`, errWeakPassword.Status},
+			{`{"current": "correct horse", "new": "battery staple"}`, http.StatusNoContent},
+		} {
+			if got := change(c.body); got != c.status {
+				t.Errorf("got %d for %s, want %d", got, c.body, c.status)
+			}
+		}
+
+		// Only the token the password was changed with is kept
+		if w := serve(h, newRequest(http.MethodGet, "/api/v1/account", token, nil)); w.Code != http.StatusOK {
+			t.Errorf("got %d with the token used for the change", w.Code)
+		}
+		if w := serve(h, newRequest(http.MethodGet, "/api/v1/account", other, nil)); w.Code != errInvalidBearerToken.Status {
+			t.Errorf("got %d with another token, want %d", w.Code,
+				errInvalidBearerToken.Status)
+		}
+		if _, err := e.createAuthToken("alice", "battery staple", ""); err != nil {
+			t.Errorf("got %v logging in with the new password", err)
+		}
+	})
+}
+
+func TestChangeUsername(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, token := loginTestUser(t, e, "alice", roleUser)
+		loginTestUser(t, e, "bob", roleUser)
+
+		for body, status := range map[string]int{
+			`{"username": "carol", "password": "wrong horse"}`:   errWrongPassword.Status,
+			`{"username": "bob", "password": "correct horse"}`:   errUsernameTaken.Status,
+			`{"username": "a/b", "password": "correct horse"}`:   errInvalidUsername.Status,
+			`{"username": "alice", "password": "correct horse"}`: http.StatusOK,
+		} {
+			w := serve(h, newRequest(http.MethodPut, "/api/v1/account/username", token,
+				strings.NewReader(body)))
+			if w.Code != status {
+				t.Errorf("got %d for %s, want %d", w.Code, body, status)
+			}
+		}
+
+		w := serve(h, newRequest(http.MethodPut, "/api/v1/account/username", token,
+			strings.NewReader(`{"username": "carol", "password": "correct horse"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d renaming the account", w.Code)
+		}
+		if _, err := e.createAuthToken("carol", "correct horse", ""); err != nil {
+			t.Errorf("got %v logging in with the new username", err)
+		}
+		if _, err := e.createAuthToken("alice", "correct horse", ""); err != errInvalidCredentials {
+			t.Errorf("got %v logging in with the old username, want %v", err,
+				errInvalidCredentials)
+		}
+	})
+}
+
+func TestDeleteAccount(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		h := testRouter(e)
+		_, admin := loginTestUser(t, e, "root", roleAdmin)
+		_, token := loginTestUser(t, e, "alice", roleUser)
+
+		remove := func(token, password string) int {
+			return serve(h, newRequest(http.MethodDelete, "/api/v1/account", token,
+				strings.NewReader(`{"password": "`+password+`"}`))).Code
+		}
+		if got := remove(admin, "correct horse"); got != errLastAdmin.Status {
+			t.Errorf("got %d deleting the last admin, want %d", got, errLastAdmin.Status)
+		}
+		if got := remove(token, "wrong horse"); got != errWrongPassword.Status {
+			t.Errorf("got %d for a wrong password, want %d", got, errWrongPassword.Status)
+		}
+		if got := remove(token, "correct horse"); got != http.StatusNoContent {
+			t.Fatalf("got %d deleting the account", got)
+		}
+
+		var n int
+		if err := e.DB.Get(&n, "SELECT COUNT(*) FROM users WHERE username=?", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Error("account left behind")
+		}
+	})
+}
+
+func TestCheckPasswordThrottled(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		id, _ := loginTestUser(t, e, "alice", roleUser)
+
+		// Right passwords don't use up the attempts
+		for i := 0; i <= maxFailures; i++ {
+			if _, err := e.checkPassword(id, "correct horse"); err != nil {
+				t.Fatalf("got %v for the right password", err)
+			}
+		}
+
+		for i := 0; i < maxFailures; i++ {
+			if _, err := e.checkPassword(id, "wrong horse"); err != errWrongPassword {
+				t.Fatalf("got %v for a wrong password, want %v", err, errWrongPassword)
+			}
+		}
+		if _, err := e.checkPassword(id, "correct horse"); err != errTooManyAttempts {
+			t.Errorf("got %v after %d wrong passwords, want %v", err, maxFailures,
+				errTooManyAttempts)
+		}
+	})
+}
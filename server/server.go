@@ -1,33 +1,84 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/go-chi/chi/middleware"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
 	"github.com/spf13/viper"
+	"github.com/voidiz/gohst/tools"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 // Server defines the database connection and the HTTP server
 // of the application
 type Server struct {
-	DB     *sqlx.DB
+	DB     *DB
 	Router *chi.Mux
+
+	requests inFlight
+}
+
+// inFlight tracks the requests being handled. Closing a connection doesn't
+// stop its handler, so the server waits for them before closing the
+// database.
+type inFlight struct {
+	mu       sync.RWMutex
+	closed   bool
+	handlers sync.WaitGroup
+}
+
+// track counts the requests handled by next, rejecting those that arrive
+// once wait has been called
+func (f *inFlight) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.RLock()
+		if f.closed {
+			f.mu.RUnlock()
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		f.handlers.Add(1)
+		f.mu.RUnlock()
+
+		defer f.handlers.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait waits for the requests in progress to finish
+func (f *inFlight) wait() {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+
+	f.handlers.Wait()
 }
 
-// Initialize creates the database connection
-func Initialize() *sqlx.DB {
-	db, err := sqlx.Connect("mysql", fmt.Sprintf("%v:%v@/gohst?parseTime=true",
-		viper.GetString("dbUser"), viper.GetString("dbPass")))
+// Initialize creates the database connection. It exits if the database
+// has pending migrations.
+func Initialize() *DB {
+	db, err := openDB()
+	if err != nil {
+		panic(err)
+	}
+
+	pending, err := pendingMigrations(db)
 	if err != nil {
 		panic(err)
 	}
+	if len(pending) > 0 {
+		fmt.Println("The database has pending migrations, run \"gohst db migrate\" first.")
+		os.Exit(1)
+	}
 
 	return db
 }
@@ -35,50 +86,145 @@ func Initialize() *sqlx.DB {
 // Run starts the server
 func (s *Server) Run(development bool) {
 	// Open DB and config
+	if viper.GetBool("db.migrate") {
+		Migrate()
+	}
 	s.DB = Initialize()
 
+	store, err := NewStorage()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	e := Env{
+		DB:                s.DB,
+		Storage:           store,
+		TempDir:           viper.GetString("tempDir"),
+		MaxFileSize:       viper.GetInt64("maxFileSize"),
+		BlockedMimeTypes:  viper.GetStringSlice("blockedMimeTypes"),
+		MinPasswordLength: viper.GetInt("passwords.minLength"),
+		Registration:      viper.GetBool("registration.enabled"),
+		TusDir:            viper.GetString("tus.dir"),
+	}
+
+	for key, d := range map[string]*time.Duration{
+		"expiry.default":    &e.DefaultExpiry,
+		"expiry.max":        &e.MaxExpiry,
+		"tokens.ttl":        &e.TokenTTL,
+		"tokens.maxTTL":     &e.MaxTokenTTL,
+		"unlockTTL":         &e.UnlockTTL,
+		"signing.expiry":    &e.SignedURLExpiry,
+		"signing.maxExpiry": &e.MaxSignedURLExpiry,
+		"tus.expiry":        &e.TusExpiry,
+	} {
+		if *d, err = tools.ParseDuration(viper.GetString(key)); err != nil {
+			log.Fatalf("Invalid %s: %v", key, err)
+		}
+	}
+
+	minLength := clampInt(e.MinPasswordLength, minPasswordLength, maxMinPasswordLength)
+	if minLength != e.MinPasswordLength {
+		log.Printf("passwords.minLength has to be between %d and %d, using %d",
+			minPasswordLength, maxMinPasswordLength, minLength)
+		e.MinPasswordLength = minLength
+	}
+
+	if err := os.MkdirAll(e.TusDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, secret := range viper.GetStringSlice("signing.keys") {
+		e.SigningKeys = append(e.SigningKeys, NewSigningKey(secret))
+	}
+	if len(e.SigningKeys) == 0 {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+		e.SigningKeys = append(e.SigningKeys, NewSigningKey(string(secret)))
+		log.Println("No signing keys configured, signed URLs and unlock cookies " +
+			"won't survive a restart")
+	}
+
 	// Initialize router
 	s.Router = chi.NewRouter()
-	e := Env{
-		DB:               s.DB,
-		StaticDir:        viper.GetString("staticDir"),
-		MaxFileSize:      viper.Get("maxFileSize").(int64),
-		BlockedMimeTypes: viper.GetStringSlice("blockedMimeTypes"),
-	}
-
-	// Routes
-	s.Router.Use(middleware.Timeout(30 * time.Second))
-	s.Router.Use(middleware.StripSlashes)
-	s.Router.Group(func(r chi.Router) {
-		// Public routes
-		r.Get("/", e.ShowIndex)
-		r.Get("/{filename:\\w+.\\w+}", e.GetFile)
-		r.Post("/login", e.CreateAuthToken)
-
-		// Protected routes
-		r.Group(func(r chi.Router) {
-			r.Use(e.AuthMiddleware)
-			r.Post("/", e.UploadFile)
-			r.Delete("/{filename:\\w+.\\w+}", e.DeleteFile)
-		})
-	})
+	s.routes(&e)
+
+	grace, err := tools.ParseDuration(viper.GetString("shutdownGrace"))
+	if err != nil {
+		log.Fatalf("Invalid shutdownGrace: %v", err)
+	}
 
-	// Scanner to delete old files
-	// go tools.StartScanner(e.StaticDir, "1s")
+	// Scanner to delete expired files and unfinished uploads
+	scanInterval, err := tools.ParseDuration(viper.GetString("scanInterval"))
+	if err != nil {
+		log.Fatalf("Invalid scanInterval: %v", err)
+	}
+	if scanInterval <= 0 {
+		log.Fatal("Invalid scanInterval: has to be longer than 0")
+	}
+	stopScanner := make(chan struct{})
+	scannerDone := make(chan struct{})
+	go func() {
+		tools.StartScanner(scanInterval, e.Reap, stopScanner)
+		close(scannerDone)
+	}()
+
+	srv := &http.Server{Handler: s.requests.track(s.Router)}
+	serveErr := make(chan error, 1)
 
 	port := viper.GetInt("port")
 	if development {
 		fmt.Printf("Starting development server on http://localhost:%v\n", port)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port),
-			s.Router))
+		srv.Addr = fmt.Sprintf(":%v", port)
+		go func() { serveErr <- srv.ListenAndServe() }()
+	} else {
+		domain := viper.GetString("domain")
+		if domain == "" {
+			log.Fatal("Missing domain, please specify one in the configuration file.")
+		}
+
+		fmt.Printf("Starting server on https://%s:%v\n", domain, port)
+		go func() { serveErr <- srv.Serve(autocert.NewListener(domain)) }()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
 	}
+	// A second signal kills the server right away
+	signal.Stop(signals)
+
+	s.shutdown(srv, grace)
+	close(stopScanner)
+	<-scannerDone
 
-	domain := viper.GetString("domain")
-	if domain == "" {
-		log.Fatal("Missing domain, please specify one in the configuration file.")
+	if err := s.DB.Close(); err != nil {
+		log.Println(err)
 	}
+	log.Println("Shut down")
+}
 
-	fmt.Printf("Starting server on https://%s:%v\n", domain, port)
+// shutdown stops accepting connections and waits up to grace for the
+// requests in progress, such as uploads, to finish. The connections that
+// are still open after that are closed and their handlers, which fail as
+// soon as they use the connection, are waited for.
+func (s *Server) shutdown(srv *http.Server, grace time.Duration) {
+	ctx := context.Background()
+	if grace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+	}
 
-	log.Fatal(http.Serve(autocert.NewListener(domain), s.Router))
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Requests still in progress after %v, closing their connections", grace)
+		srv.Close()
+	}
+	s.requests.wait()
 }
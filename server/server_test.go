@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInFlight(t *testing.T) {
+	var f inFlight
+	started, release := make(chan struct{}), make(chan struct{})
+	h := f.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	}))
+
+	slow := make(chan int)
+	go func() { slow <- serve(h, newRequest(http.MethodGet, "/slow", "", nil)).Code }()
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		f.wait()
+		close(done)
+	}()
+
+	// Requests arriving after wait has been called are turned away
+	deadline := time.Now().Add(5 * time.Second)
+	for serve(h, newRequest(http.MethodGet, "/", "", nil)).Code != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("requests still accepted after wait")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("wait returned with a request in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("got %d for the request in progress, want %d", code, http.StatusOK)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait didn't return once the request finished")
+	}
+}
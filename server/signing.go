@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/voidiz/gohst/tools"
+)
+
+// Private files can only be downloaded through signed URLs, which carry
+// an expiry time, optionally the IP address they are bound to, the ID of
+// the signing key and an HMAC of those values.
+//
+// New URLs are signed with the first of the configured signing keys while
+// all of them are accepted, so a key can be rotated by adding a new one in
+// front and removing the old one once the URLs it signed have expired.
+
+// SigningKey is a secret used to sign URLs and unlock cookies
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// NewSigningKey returns a signing key for secret. Its ID is derived from
+// the secret so that it doesn't have to be configured separately.
+func NewSigningKey(secret string) SigningKey {
+	sum := sha256.Sum256([]byte(secret))
+	return SigningKey{ID: hex.EncodeToString(sum[:4]), Secret: []byte(secret)}
+}
+
+// SignFile returns a signed URL for a file readable by the account. The
+// expires form field sets how long it is valid and ip binds it to an IP
+// address, or to the address of the caller if set to "true".
+func (e *Env) SignFile(w http.ResponseWriter, r *http.Request) {
+	signed, _, err := e.signFileURL(r, chi.URLParam(r, "filename"),
+		r.PostFormValue("expires"), r.PostFormValue("ip"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(signed))
+}
+
+// signFileURL returns a signed URL for a file the authenticated account
+// owns or has been granted the read right on, along with its expiry time
+func (e *Env) signFileURL(r *http.Request, fileName, expires,
+	ip string) (string, time.Time, error) {
+	_, err := e.fileAccess(accountID(r), fileName, permRead)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	ttl := e.SignedURLExpiry
+	if expires != "" {
+		ttl, err = tools.ParseDuration(expires)
+		if err != nil || ttl <= 0 || (e.MaxSignedURLExpiry > 0 && ttl > e.MaxSignedURLExpiry) {
+			return "", time.Time{}, errInvalidExpiry
+		}
+	}
+
+	switch ip {
+	case "", "false":
+		ip = ""
+	case "true":
+		ip = clientIP(r)
+	default:
+		if net.ParseIP(ip) == nil {
+			return "", time.Time{}, errInvalidIP
+		}
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	signed := fileURL(r, fileName) + "?" + e.signQuery(fileName, expiresAt, ip).Encode()
+	return signed, expiresAt, nil
+}
+
+// signQuery returns the query parameters of a signed URL for fileName
+func (e *Env) signQuery(fileName string, expires time.Time, ip string) url.Values {
+	key := e.SigningKeys[0]
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	q := url.Values{}
+	q.Set("expires", exp)
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	q.Set("kid", key.ID)
+	q.Set("sig", signature(key.Secret, fileName, exp, ip))
+	return q
+}
+
+// validSignature reports whether the request for fileName carries a valid
+// and unexpired signature
+func (e *Env) validSignature(r *http.Request, fileName string) bool {
+	q := r.URL.Query()
+
+	exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+
+	ip := q.Get("ip")
+	if ip != "" && ip != clientIP(r) {
+		return false
+	}
+
+	for _, key := range e.SigningKeys {
+		if key.ID == q.Get("kid") {
+			return hmac.Equal([]byte(q.Get("sig")),
+				[]byte(signature(key.Secret, fileName, q.Get("expires"), ip)))
+		}
+	}
+	return false
+}
+
+func signature(secret []byte, values ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, v := range values {
+		mac.Write([]byte(v + "\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientIP returns the IP address the request was made from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
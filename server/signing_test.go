@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// signedRequest returns a request for fileName with the query q, made
+// from the IP address ip
+func signedRequest(fileName string, q url.Values, ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/"+fileName+"?"+q.Encode(), nil)
+	r.RemoteAddr = ip + ":1234"
+	return r
+}
+
+func TestValidSignature(t *testing.T) {
+	e := &Env{SigningKeys: []SigningKey{NewSigningKey("secret")}}
+	expires := time.Now().Add(time.Hour)
+
+	q := e.signQuery("a.txt", expires, "")
+	if !e.validSignature(signedRequest("a.txt", q, "192.0.2.1"), "a.txt") {
+		t.Error("valid signature rejected")
+	}
+	if e.validSignature(signedRequest("b.txt", q, "192.0.2.1"), "b.txt") {
+		t.Error("signature accepted for another file")
+	}
+
+	expired := e.signQuery("a.txt", time.Now().Add(-time.Minute), "")
+	if e.validSignature(signedRequest("a.txt", expired, "192.0.2.1"), "a.txt") {
+		t.Error("expired signature accepted")
+	}
+
+	extended := e.signQuery("a.txt", expires, "")
+	extended.Set("expires", strconv.FormatInt(expires.Add(time.Hour).Unix(), 10))
+	if e.validSignature(signedRequest("a.txt", extended, "192.0.2.1"), "a.txt") {
+		t.Error("signature accepted with a changed expiry")
+	}
+
+	unknown := e.signQuery("a.txt", expires, "")
+	unknown.Set("kid", "unknown")
+	if e.validSignature(signedRequest("a.txt", unknown, "192.0.2.1"), "a.txt") {
+		t.Error("signature accepted with an unknown key")
+	}
+}
+
+func TestValidSignatureIP(t *testing.T) {
+	e := &Env{SigningKeys: []SigningKey{NewSigningKey("secret")}}
+	q := e.signQuery("a.txt", time.Now().Add(time.Hour), "192.0.2.1")
+
+	if !e.validSignature(signedRequest("a.txt", q, "192.0.2.1"), "a.txt") {
+		t.Error("signature rejected from the IP address it is bound to")
+	}
+	if e.validSignature(signedRequest("a.txt", q, "192.0.2.2"), "a.txt") {
+		t.Error("signature accepted from another IP address")
+	}
+
+	// Dropping the IP address from the URL breaks the signature
+	q.Del("ip")
+	if e.validSignature(signedRequest("a.txt", q, "192.0.2.2"), "a.txt") {
+		t.Error("signature accepted without the IP address it is bound to")
+	}
+}
+
+func TestValidSignatureRotation(t *testing.T) {
+	old := &Env{SigningKeys: []SigningKey{NewSigningKey("old")}}
+	q := old.signQuery("a.txt", time.Now().Add(time.Hour), "")
+
+	e := &Env{SigningKeys: []SigningKey{NewSigningKey("new"), NewSigningKey("old")}}
+	if !e.validSignature(signedRequest("a.txt", q, "192.0.2.1"), "a.txt") {
+		t.Error("signature by a previous key rejected")
+	}
+
+	e.SigningKeys = e.SigningKeys[:1]
+	if e.validSignature(signedRequest("a.txt", q, "192.0.2.1"), "a.txt") {
+		t.Error("signature by a removed key accepted")
+	}
+}
+
+func TestSignFileURL(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		e.SigningKeys = []SigningKey{NewSigningKey("secret")}
+		e.SignedURLExpiry = time.Hour
+
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := storeTestFile(t, e, id, "a.txt", "hello",
+			url.Values{"private": {"true"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/sign", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r = r.WithContext(context.WithValue(r.Context(), credentialKey,
+			credential{AccountID: id}))
+
+		// "true" binds the URL to the address of the caller
+		signed, _, err := e.signFileURL(r, file.Name, "", "true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Query().Get("ip") != "192.0.2.1" {
+			t.Errorf("got %s, want a URL bound to 192.0.2.1", signed)
+		}
+
+		router := chi.NewRouter()
+		router.Get("/{filename}", e.GetFile)
+		for _, c := range []struct {
+			q      url.Values
+			ip     string
+			status int
+		}{
+			{u.Query(), "192.0.2.1", http.StatusOK},
+			{u.Query(), "192.0.2.2", http.StatusForbidden},
+			{url.Values{}, "192.0.2.1", http.StatusForbidden},
+		} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, signedRequest(file.Name, c.q, c.ip))
+			if w.Code != c.status {
+				t.Errorf("got %d for ?%s from %s, want %d", w.Code, c.q.Encode(),
+					c.ip, c.status)
+			}
+		}
+
+		if _, _, err := e.signFileURL(r, file.Name, "", "not an ip"); err != errInvalidIP {
+			t.Errorf("got %v for an invalid IP address, want %v", err, errInvalidIP)
+		}
+
+		bob, err := insertUser(e.DB, "bob", roleUser, "battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), credentialKey,
+			credential{AccountID: bob}))
+		if _, _, err := e.signFileURL(r, file.Name, "", ""); err != errNotOwner {
+			t.Errorf("got %v signing another account's file, want %v", err, errNotOwner)
+		}
+	})
+}
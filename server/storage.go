@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+	"github.com/voidiz/gohst/storage"
+)
+
+// NewStorage returns the storage backend selected by the storage.backend
+// setting in the configuration file
+func NewStorage() (storage.Storage, error) {
+	switch backend := viper.GetString("storage.backend"); backend {
+	case "local":
+		return storage.NewLocal(viper.GetString("staticDir")), nil
+	case "memory":
+		return storage.NewMemory(), nil
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  viper.GetString("storage.s3.endpoint"),
+			Bucket:    viper.GetString("storage.s3.bucket"),
+			Region:    viper.GetString("storage.s3.region"),
+			AccessKey: viper.GetString("storage.s3.accessKey"),
+			SecretKey: viper.GetString("storage.s3.secretKey"),
+			UseSSL:    viper.GetBool("storage.s3.useSSL"),
+			PathStyle: viper.GetBool("storage.s3.pathStyle"),
+			Prefix:    viper.GetString("storage.s3.prefix"),
+			Presign:   viper.GetDuration("storage.s3.presign"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Password checks are throttled to slow down guessing. A key, such as the
+// IP address of a client, that sends maxFailures wrong passwords is refused
+// until failureWindow has passed since the first of them. Every check
+// counts as a failure until it succeeds, so that concurrent guesses can't
+// all get in while their passwords are being compared.
+
+const (
+	maxFailures   = 10
+	failureWindow = 15 * time.Minute
+)
+
+// throttle counts the wrong passwords sent by every key. The zero value is
+// ready to use.
+type throttle struct {
+	mu       sync.Mutex
+	failures map[string]failures
+}
+
+type failures struct {
+	n     int
+	since time.Time
+}
+
+// attempt records an attempt by key to send a password as a failure, or
+// reports false if key has no attempts left
+func (t *throttle) attempt(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failures == nil {
+		t.failures = make(map[string]failures)
+	}
+
+	now := time.Now()
+	f := t.failures[key]
+	if now.Sub(f.since) > failureWindow {
+		f = failures{since: now}
+	}
+	if f.n >= maxFailures {
+		return false
+	}
+	f.n++
+	t.failures[key] = f
+	return true
+}
+
+// succeed takes back the failure recorded by an attempt whose password
+// turned out to be right
+func (t *throttle) succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok {
+		return
+	}
+	if f.n--; f.n <= 0 {
+		delete(t.failures, key)
+		return
+	}
+	t.failures[key] = f
+}
+
+// reap forgets the keys whose window has passed
+func (t *throttle) reap() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, f := range t.failures {
+		if time.Since(f.since) > failureWindow {
+			delete(t.failures, key)
+		}
+	}
+}
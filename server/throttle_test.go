@@ -0,0 +1,68 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottleConcurrent(t *testing.T) {
+	var th throttle
+
+	// Every guess is wrong, but none of them is known to be wrong before
+	// all of them have been let in
+	var (
+		mu      sync.Mutex
+		allowed int
+		wg      sync.WaitGroup
+		start   = make(chan struct{})
+	)
+	for i := 0; i < 5*maxFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if th.attempt("192.0.2.1") {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if allowed != maxFailures {
+		t.Errorf("let in %d concurrent guesses, want %d", allowed, maxFailures)
+	}
+	if !th.attempt("192.0.2.2") {
+		t.Error("another key throttled")
+	}
+}
+
+func TestThrottleSucceed(t *testing.T) {
+	var th throttle
+
+	// Right passwords don't count towards the limit
+	for i := 0; i < 2*maxFailures; i++ {
+		if !th.attempt("alice") {
+			t.Fatalf("attempt %d refused after only right passwords", i+1)
+		}
+		th.succeed("alice")
+	}
+
+	for i := 0; i < maxFailures; i++ {
+		th.attempt("alice")
+	}
+	if th.attempt("alice") {
+		t.Error("attempt allowed after too many wrong passwords")
+	}
+
+	// Until the window has passed
+	f := th.failures["alice"]
+	f.since = time.Now().Add(-failureWindow - time.Second)
+	th.failures["alice"] = f
+	if !th.attempt("alice") {
+		t.Error("attempt refused after the window has passed")
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Login tokens are stored as their SHA-256 along with a short prefix that
+// identifies them in listings, so that the database doesn't hold any usable
+// credentials. Tokens are random enough that a plain hash can't be reversed.
+// They are looked up by their hash, the lookup is the comparison: timing it
+// only tells how much of a hash matches, which says nothing about a token.
+
+// authTokenPrefix starts every login token
+const authTokenPrefix = "gt_"
+
+// tokenJSON is the JSON representation of a bearer token. The token itself
+// is only ever returned when it is created.
+type tokenJSON struct {
+	ID         int        `json:"id"`
+	Prefix     string     `json:"prefix"`
+	Current    bool       `json:"current"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Logout revokes the token or API key the request was made with
+func (e *Env) Logout(w http.ResponseWriter, r *http.Request) {
+	if err := e.logout(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Successfully logged out"))
+}
+
+// APIListTokens lists the unexpired tokens of the account
+func (e *Env) APIListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := accountTokens(e.DB, accountID(r))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	list := make([]tokenJSON, len(tokens))
+	for i, au := range tokens {
+		list[i] = tokenJSON{
+			ID:         au.ID,
+			Prefix:     au.Prefix,
+			Current:    au.ID == requestCredential(r).TokenID,
+			ExpiresAt:  au.ExpiresAt,
+			LastUsedAt: au.LastUsedAt,
+			CreatedAt:  au.CreatedAt,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Tokens []tokenJSON `json:"tokens"`
+	}{list})
+}
+
+// APIRevokeToken revokes a token of the account
+func (e *Env) APIRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, errTokenNotFound)
+		return
+	}
+
+	if err := revokeToken(e.DB, accountID(r), id); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APILogout revokes the token or API key the request was made with
+func (e *Env) APILogout(w http.ResponseWriter, r *http.Request) {
+	if err := e.logout(r); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Env) logout(r *http.Request) error {
+	cred := requestCredential(r)
+	if cred.Key != nil {
+		return revokeAPIKey(e.DB, cred.AccountID, cred.Key.ID)
+	}
+	return revokeToken(e.DB, cred.AccountID, cred.TokenID)
+}
+
+// ReapExpiredTokens deletes the tokens and API keys that have expired
+func (e *Env) ReapExpiredTokens() error {
+	for _, table := range []string{"auth_tokens", "api_keys"} {
+		_, err := e.DB.Exec(`DELETE FROM `+table+`
+			WHERE expires_at IS NOT NULL AND expires_at<?`, dbNow())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func accountTokens(db *DB, accountID int) ([]AuthToken, error) {
+	tokens := []AuthToken{}
+	err := db.Select(&tokens, `SELECT * FROM auth_tokens
+		WHERE account_id=? AND (expires_at IS NULL OR expires_at>?)
+		ORDER BY id`, accountID, dbNow())
+	return tokens, err
+}
+
+func revokeToken(db *DB, accountID, id int) error {
+	res, err := db.Exec("DELETE FROM auth_tokens WHERE id=? AND account_id=?",
+		id, accountID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return errTokenNotFound
+	}
+	return nil
+}
+
+// ListTokens prints the unexpired tokens of the supplied username
+func ListTokens(user string) {
+	db := Initialize()
+
+	id := accountByName(db, user)
+	tokens, err := accountTokens(db, id)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(tokens) == 0 {
+		fmt.Printf("User \"%s\" has no tokens.\n", user)
+		return
+	}
+
+	fmt.Printf("%-8s %-12s %-20s %-20s %s\n", "ID", "PREFIX", "CREATED",
+		"LAST USED", "EXPIRES")
+	for _, au := range tokens {
+		fmt.Printf("%-8d %-12s %-20s %-20s %s\n", au.ID, au.Prefix,
+			formatTime(&au.CreatedAt), formatTime(au.LastUsedAt), formatTime(au.ExpiresAt))
+	}
+}
+
+// RevokeTokens revokes a token of the supplied username, or all of them if
+// id is 0
+func RevokeTokens(user string, id int) {
+	db := Initialize()
+
+	accountID := accountByName(db, user)
+	if id != 0 {
+		if err := revokeToken(db, accountID, id); err != nil {
+			if err == errTokenNotFound {
+				fmt.Printf("User \"%s\" has no token %d!\n", user, id)
+				os.Exit(1)
+			}
+			panic(err)
+		}
+		fmt.Printf("Revoked token %d of \"%s\"!\n", id, user)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM auth_tokens WHERE account_id=?", accountID)
+	if err != nil {
+		panic(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Revoked %d tokens of \"%s\"!\n", n, user)
+}
+
+// hashToken returns the hex encoded SHA-256 of a login token or API key
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenPrefix returns the part of a token that is stored in the clear to
+// identify it: the type prefix followed by 8 characters
+func tokenPrefix(token string) string {
+	if len(token) > 11 {
+		return token[:11]
+	}
+	return token
+}
+
+// accountByName returns the ID of the supplied username, exiting if the
+// user doesn't exist
+func accountByName(db *DB, user string) int {
+	var id int
+	err := db.Get(&id, "SELECT id FROM users WHERE username=?", user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			fmt.Printf("User \"%s\" does not exist!\n", user)
+			os.Exit(1)
+		}
+		panic(err)
+	}
+	return id
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
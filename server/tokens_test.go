@@ -0,0 +1,105 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthTokenHashed(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := e.createAuthToken("alice", "correct horse", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var au AuthToken
+		if err := e.DB.Get(&au, "SELECT * FROM auth_tokens WHERE account_id=?", id); err != nil {
+			t.Fatal(err)
+		}
+		if au.TokenHash != hashToken(token) {
+			t.Errorf("stored hash %s, want the SHA-256 of the token", au.TokenHash)
+		}
+		if au.Prefix != token[:11] {
+			t.Errorf("stored prefix %q, want %q", au.Prefix, token[:11])
+		}
+
+		cred, err := e.findCredential(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.AccountID != id || cred.TokenID != au.ID {
+			t.Errorf("token found for account %d, token %d", cred.AccountID, cred.TokenID)
+		}
+
+		// The stored hash is no use as a token
+		if _, err := e.findCredential(au.TokenHash); err != errInvalidBearerToken {
+			t.Errorf("got %v for the hash of a token, want %v", err, errInvalidBearerToken)
+		}
+	})
+}
+
+func TestAuthTokenExpired(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		id, err := insertUser(e.DB, "alice", roleUser, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token := authTokenPrefix + "expired"
+		_, err = e.DB.Exec(`INSERT INTO auth_tokens (account_id, token_hash, prefix, expires_at)
+			VALUES (?, ?, ?, ?)`, id, hashToken(token), tokenPrefix(token),
+			dbNow().Add(-time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := e.findCredential(token); err != errInvalidBearerToken {
+			t.Errorf("got %v for an expired token, want %v", err, errInvalidBearerToken)
+		}
+	})
+}
+
+func TestHashStoredTokens(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		// Back to when tokens were stored in the clear
+		rollbackBefore(t, e, "hashed tokens")
+		_, err := e.DB.Exec("INSERT INTO users (username, password) VALUES (?, ?)",
+			"alice", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var id int
+		if err := e.DB.Get(&id, "SELECT id FROM users WHERE username=?", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		_, err = e.DB.Exec("INSERT INTO auth_tokens (account_id, token) VALUES (?, ?)",
+			id, "legacy-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := migrateDB(e.DB, e.Storage); err != nil {
+			t.Fatal(err)
+		}
+
+		cred, err := e.findCredential("legacy-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.AccountID != id {
+			t.Errorf("token found for account %d, want %d", cred.AccountID, id)
+		}
+
+		var prefix string
+		if err := e.DB.Get(&prefix, "SELECT prefix FROM auth_tokens"); err != nil {
+			t.Fatal(err)
+		}
+		if prefix != "lega" {
+			t.Errorf("stored prefix %q of an older token, want %q", prefix, "lega")
+		}
+	})
+}
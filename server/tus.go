@@ -0,0 +1,403 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io) with
+// the creation, termination and expiration extensions. Chunks are appended
+// to a partial file in TusDir and once the last one arrives the file is
+// stored like a regular upload.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusOctetType  = "application/offset+octet-stream"
+
+	// tusPasswordHash replaces the password in the stored metadata with its
+	// bcrypt hash. Clients can't set it, it is dropped from their metadata.
+	tusPasswordHash = "gohst-password-hash"
+)
+
+// busySet tracks the tus uploads that are currently receiving a chunk, so
+// that concurrent PATCH requests can't write to the same partial file
+type busySet struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (b *busySet) acquire(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ids == nil {
+		b.ids = make(map[string]bool)
+	}
+	if b.ids[id] {
+		return false
+	}
+	b.ids[id] = true
+	return true
+}
+
+func (b *busySet) release(id string) {
+	b.mu.Lock()
+	delete(b.ids, id)
+	b.mu.Unlock()
+}
+
+// TusMiddleware sets the headers shared by every tus response and rejects
+// requests made with an unsupported protocol version
+func (e *Env) TusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method != http.MethodOptions &&
+			r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TusOptions describes the supported tus version and extensions
+func (e *Env) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(e.MaxFileSize-1, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreate creates a new upload of the size given in Upload-Length
+func (e *Env) TusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+
+	key := requestCredential(r).Key
+	limit, byQuota, err := e.uploadAllowance(accountID(r), key)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	if length >= limit {
+		if byQuota {
+			uploadError(w, errQuotaExceeded)
+			return
+		}
+		http.Error(w, errFileTooLarge.Message, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	fields := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if e.fileBlocked(fields.Get("filetype")) {
+		uploadError(w, errFileBlocked)
+		return
+	}
+	if filetype := fields.Get("filetype"); filetype != "" && !key.allowsMimeType(filetype) {
+		uploadError(w, errFileTypeNotAllowed)
+		return
+	}
+
+	opts, err := e.parseUploadOptions(fields)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	// The password isn't kept in the clear until the upload is finished
+	fields.Del("password")
+	fields.Del(tusPasswordHash)
+	if opts.Password != nil {
+		fields.Set(tusPasswordHash, *opts.Password)
+	}
+	metadata := formatTusMetadata(fields)
+
+	id, err := generateUploadID()
+	if err != nil {
+		http.Error(w, "Server error, try again", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.OpenFile(e.tusPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	expires := dbNow().Add(e.TusExpiry)
+	_, err = e.DB.Exec(`INSERT INTO tus_uploads
+		(id, account_id, upload_length, metadata, expires_at)
+		VALUES (?, ?, ?, ?, ?)`, id, accountID(r), length, metadata, expires)
+	if err != nil {
+		os.Remove(e.tusPath(id))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", tusLocation(r, id))
+	w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHead returns the current offset of an upload
+func (e *Env) TusHead(w http.ResponseWriter, r *http.Request) {
+	tu, ok := e.findTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(tu.Received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(tu.UploadLength, 10))
+	w.Header().Set("Upload-Expires", tu.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatch appends a chunk to an upload. When the last chunk has been
+// received the upload is stored and its URL returned in Gohst-File-Url.
+func (e *Env) TusPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != tusOctetType {
+		http.Error(w, "Content-Type must be "+tusOctetType,
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if !e.tusBusy.acquire(id) {
+		http.Error(w, "Upload is already receiving data", http.StatusConflict)
+		return
+	}
+	defer e.tusBusy.release(id)
+
+	tu, ok := e.findTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if offset != tu.Received {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(e.tusPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := f.Seek(tu.Received, io.SeekStart); err != nil {
+		f.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Keep whatever arrived before an interrupted connection so that the
+	// client can resume from there
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, tu.UploadLength-tu.Received))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	tu.Received += n
+
+	_, err = e.DB.Exec("UPDATE tus_uploads SET received=? WHERE id=?",
+		tu.Received, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		http.Error(w, copyErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(tu.Received, 10))
+	w.Header().Set("Upload-Expires", tu.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	if tu.Received == tu.UploadLength {
+		fileName, err := e.finishTusUpload(tu, requestCredential(r).Key)
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		w.Header().Set("Gohst-File-Url", fileURL(r, fileName))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDelete terminates an upload and removes the data received so far
+func (e *Env) TusDelete(w http.ResponseWriter, r *http.Request) {
+	tu, ok := e.findTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := e.removeTusUpload(tu.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findTusUpload looks up the upload in the URL for the authenticated
+// account. If it can't be found an error is written and ok is false.
+func (e *Env) findTusUpload(w http.ResponseWriter, r *http.Request) (tu TusUpload, ok bool) {
+	err := e.DB.QueryRowx("SELECT * FROM tus_uploads WHERE id=? AND account_id=?",
+		chi.URLParam(r, "id"), accountID(r)).StructScan(&tu)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return tu, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return tu, false
+	}
+
+	if time.Now().After(tu.ExpiresAt) {
+		e.removeTusUpload(tu.ID)
+		http.NotFound(w, r)
+		return tu, false
+	}
+
+	return tu, true
+}
+
+// finishTusUpload stores a completely received upload like a regular one
+// and removes it from the pending uploads. The restrictions of key, the
+// API key used to send the last chunk, apply to the upload.
+func (e *Env) finishTusUpload(tu TusUpload, key *APIKey) (string, error) {
+	fields := parseTusMetadata(tu.Metadata)
+	up, err := openUpload(e.tusPath(tu.ID), fields.Get("filename"),
+		fields.Get("filetype"), fields)
+	if err != nil {
+		return "", err
+	}
+	up.PasswordHash = fields.Get(tusPasswordHash)
+
+	// The partial file is kept on server errors, so that the client can
+	// retry by sending an empty chunk at the final offset
+	file, err := e.storeUpload(tu.AccountID, key, up)
+	up.File.Close()
+	if err != nil {
+		switch err {
+		case errFileBlocked, errFileTypeNotAllowed, errFileTooLarge,
+			errInvalidExpiry, errInvalidLimit, errInvalidPrivate:
+			e.removeTusUpload(tu.ID)
+		}
+		return "", err
+	}
+
+	return file.Name, e.removeTusUpload(tu.ID)
+}
+
+func (e *Env) removeTusUpload(id string) error {
+	if _, err := e.DB.Exec("DELETE FROM tus_uploads WHERE id=?", id); err != nil {
+		return err
+	}
+
+	err := os.Remove(e.tusPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReapTusUploads removes the uploads that have expired before completion
+func (e *Env) ReapTusUploads() error {
+	var ids []string
+	err := e.DB.Select(&ids, "SELECT id FROM tus_uploads WHERE expires_at<?",
+		dbNow())
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := e.removeTusUpload(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Env) tusPath(id string) string {
+	return filepath.Join(e.TusDir, id)
+}
+
+// tusLocation returns the URL of an upload, relative to the creation URL
+func tusLocation(r *http.Request, id string) string {
+	return strings.TrimSuffix(r.URL.Path, "/") + "/" + id
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, which consists of
+// comma separated keys and base64 encoded values. Besides filename and
+// filetype, the metadata can hold the same options as the upload form.
+func parseTusMetadata(header string) url.Values {
+	metadata := url.Values{}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		switch len(kv) {
+		case 1:
+			metadata.Set(kv[0], "")
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(kv[1])
+			if err == nil {
+				metadata.Set(kv[0], string(value))
+			}
+		}
+	}
+	return metadata
+}
+
+// formatTusMetadata encodes metadata like an Upload-Metadata header
+func formatTusMetadata(metadata url.Values) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key
+		if value := metadata.Get(key); value != "" {
+			pairs[i] += " " + base64.StdEncoding.EncodeToString([]byte(value))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func generateUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
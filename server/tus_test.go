@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTusDir runs test with a temporary directory for partial uploads
+func withTusDir(t *testing.T, e *Env, test func()) {
+	dir, err := ioutil.TempDir("", "gohst-tus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e.TusDir = dir
+	e.TusExpiry = time.Hour
+	e.MaxFileSize = 1 << 20
+	test()
+}
+
+// tusRequest returns a tus request authenticated with token
+func tusRequest(method, path, token, body string) *http.Request {
+	r := newRequest(method, path, token, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	if method == http.MethodPatch {
+		r.Header.Set("Content-Type", tusOctetType)
+	}
+	return r
+}
+
+// createTusUpload creates an upload of length bytes and returns its URL
+func createTusUpload(t *testing.T, h http.Handler, token string, length int) string {
+	r := tusRequest(http.MethodPost, "/files", token, "")
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", "filename "+
+		base64.StdEncoding.EncodeToString([]byte("a.txt")))
+
+	w := serve(h, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d creating an upload, want %d: %s", w.Code,
+			http.StatusCreated, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+// patchTus sends a chunk at offset
+func patchTus(location, token string, offset int, chunk string) *http.Request {
+	r := tusRequest(http.MethodPatch, location, token, chunk)
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return r
+}
+
+func TestTusResume(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		withTusDir(t, e, func() {
+			h := testRouter(e)
+			id, token := loginTestUser(t, e, "alice", roleUser)
+			location := createTusUpload(t, h, token, 11)
+
+			w := serve(h, patchTus(location, token, 0, "hello "))
+			if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "6" {
+				t.Fatalf("got %d at offset %s after the first chunk", w.Code,
+					w.Header().Get("Upload-Offset"))
+			}
+
+			// A client resuming after a dropped connection asks for the offset
+			w = serve(h, tusRequest(http.MethodHead, location, token, ""))
+			if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "6" ||
+				w.Header().Get("Upload-Length") != "11" {
+				t.Fatalf("got %d at offset %s of %s", w.Code,
+					w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+			}
+
+			w = serve(h, patchTus(location, token, 6, "world"))
+			if w.Code != http.StatusNoContent || w.Header().Get("Gohst-File-Url") == "" {
+				t.Fatalf("got %d without a file URL after the last chunk: %s",
+					w.Code, w.Body)
+			}
+
+			var file UserFile
+			if err := e.DB.Get(&file, "SELECT * FROM user_files WHERE account_id=?", id); err != nil {
+				t.Fatal(err)
+			}
+			if file.OriginalName != "a.txt" || file.Size != 11 {
+				t.Errorf("stored %s of %d bytes, want a.txt of 11 bytes",
+					file.OriginalName, file.Size)
+			}
+
+			// The partial upload is gone once it has been stored
+			if w := serve(h, tusRequest(http.MethodHead, location, token, "")); w.Code != http.StatusNotFound {
+				t.Errorf("got %d for a finished upload, want %d", w.Code, http.StatusNotFound)
+			}
+			infos, err := ioutil.ReadDir(e.TusDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(infos) > 0 {
+				t.Errorf("%d partial files left behind", len(infos))
+			}
+		})
+	})
+}
+
+func TestTusWrongOffset(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		withTusDir(t, e, func() {
+			h := testRouter(e)
+			_, token := loginTestUser(t, e, "alice", roleUser)
+			location := createTusUpload(t, h, token, 11)
+
+			if w := serve(h, patchTus(location, token, 0, "hello ")); w.Code != http.StatusNoContent {
+				t.Fatalf("got %d for the first chunk", w.Code)
+			}
+			for _, offset := range []int{0, 3, 11} {
+				w := serve(h, patchTus(location, token, offset, "world"))
+				if w.Code != http.StatusConflict {
+					t.Errorf("got %d at offset %d, want %d", w.Code, offset,
+						http.StatusConflict)
+				}
+			}
+
+			// Data past the length of the upload is ignored
+			w := serve(h, patchTus(location, token, 6, "world and more"))
+			if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "11" {
+				t.Errorf("got %d at offset %s for an overlong chunk", w.Code,
+					w.Header().Get("Upload-Offset"))
+			}
+		})
+	})
+}
+
+func TestTusOversize(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		withTusDir(t, e, func() {
+			h := testRouter(e)
+			_, token := loginTestUser(t, e, "alice", roleUser)
+
+			r := tusRequest(http.MethodPost, "/files", token, "")
+			r.Header.Set("Upload-Length", strconv.FormatInt(e.MaxFileSize, 10))
+			if w := serve(h, r); w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("got %d for an upload of the maximum size, want %d", w.Code,
+					http.StatusRequestEntityTooLarge)
+			}
+
+			r = tusRequest(http.MethodPost, "/files", token, "")
+			r.Header.Set("Upload-Length", "-1")
+			if w := serve(h, r); w.Code != http.StatusBadRequest {
+				t.Errorf("got %d for a negative length, want %d", w.Code,
+					http.StatusBadRequest)
+			}
+		})
+	})
+}
+
+func TestTusAccess(t *testing.T) {
+	forEachDB(t, func(t *testing.T, e *Env) {
+		withTusDir(t, e, func() {
+			h := testRouter(e)
+			_, alice := loginTestUser(t, e, "alice", roleUser)
+			_, bob := loginTestUser(t, e, "bob", roleUser)
+			location := createTusUpload(t, h, alice, 11)
+
+			if w := serve(h, patchTus(location, bob, 0, "hello ")); w.Code != http.StatusNotFound {
+				t.Errorf("got %d writing to another account's upload, want %d", w.Code,
+					http.StatusNotFound)
+			}
+
+			r := patchTus(location, alice, 0, "hello ")
+			r.Header.Set("Tus-Resumable", "0.2.0")
+			if w := serve(h, r); w.Code != http.StatusPreconditionFailed {
+				t.Errorf("got %d for an unsupported version, want %d", w.Code,
+					http.StatusPreconditionFailed)
+			}
+
+			if w := serve(h, tusRequest(http.MethodDelete, location, alice, "")); w.Code != http.StatusNoContent {
+				t.Fatalf("got %d terminating the upload", w.Code)
+			}
+			if w := serve(h, tusRequest(http.MethodHead, location, alice, "")); w.Code != http.StatusNotFound {
+				t.Errorf("got %d for a terminated upload, want %d", w.Code,
+					http.StatusNotFound)
+			}
+		})
+	})
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password protected files can be unlocked by sending the password in the
+// File-Password header, or through a form which sets a cookie that keeps
+// the file unlocked for a while. Both are throttled by the IP address of
+// the client.
+
+const (
+	filePasswordHeader = "File-Password"
+	unlockCookiePrefix = "gohst_unlock_"
+)
+
+var unlockForm = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+</head>
+<body>
+<form method="post">
+<p>{{.Name}} is password protected.</p>
+{{if .Failed}}<p>Wrong password, try again.</p>{{end}}
+<input type="password" name="password" autofocus required>
+<button type="submit">Unlock</button>
+</form>
+</body>
+</html>
+`))
+
+// UnlockFile checks the password posted from the unlock form and sets a
+// cookie that unlocks the file on success
+func (e *Env) UnlockFile(w http.ResponseWriter, r *http.Request) {
+	fileName := chi.URLParam(r, "filename")
+
+	var hash *string
+	err := e.DB.Get(&hash, `SELECT password FROM user_files
+		WHERE name=? AND (expires_at IS NULL OR expires_at>?)`, fileName, dbNow())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if hash == nil {
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		return
+	}
+
+	ip := clientIP(r)
+	if !e.unlockThrottle.attempt(ip) {
+		writeError(w, errTooManyAttempts)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(*hash),
+		[]byte(r.PostFormValue("password"))) != nil {
+		showUnlockForm(w, fileName, true)
+		return
+	}
+	e.unlockThrottle.succeed(ip)
+
+	expires := time.Now().Add(e.UnlockTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookiePrefix + fileName,
+		Value:    e.signUnlock(fileName, expires),
+		Path:     "/" + fileName,
+		Expires:  expires,
+		MaxAge:   int(e.UnlockTTL.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+}
+
+// fileUnlocked reports whether the request may download a password
+// protected file. If not, the unlock form or an error has been written.
+func (e *Env) fileUnlocked(w http.ResponseWriter, r *http.Request, fileName,
+	hash string) bool {
+	if password := r.Header.Get(filePasswordHeader); password != "" {
+		ip := clientIP(r)
+		if !e.unlockThrottle.attempt(ip) {
+			writeError(w, errTooManyAttempts)
+			return false
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return false
+		}
+		e.unlockThrottle.succeed(ip)
+		return true
+	}
+
+	if c, err := r.Cookie(unlockCookiePrefix + fileName); err == nil &&
+		e.verifyUnlock(fileName, c.Value) {
+		return true
+	}
+
+	showUnlockForm(w, fileName, false)
+	return false
+}
+
+func showUnlockForm(w http.ResponseWriter, fileName string, failed bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	unlockForm.Execute(w, struct {
+		Name   string
+		Failed bool
+	}{fileName, failed})
+}
+
+// signUnlock returns a cookie value proving that fileName was unlocked,
+// valid until expires
+func (e *Env) signUnlock(fileName string, expires time.Time) string {
+	key := e.SigningKeys[0]
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + key.ID + "." + signature(key.Secret, "unlock", fileName, exp)
+}
+
+func (e *Env) verifyUnlock(fileName, value string) bool {
+	parts := strings.SplitN(value, ".", 3)
+	if len(parts) != 3 {
+		return false
+	}
+
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+
+	for _, key := range e.SigningKeys {
+		if key.ID == parts[1] {
+			return hmac.Equal([]byte(parts[2]),
+				[]byte(signature(key.Secret, "unlock", fileName, parts[0])))
+		}
+	}
+	return false
+}
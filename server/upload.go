@@ -0,0 +1,347 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/voidiz/gohst/tools"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// sniffLen is the number of leading bytes kept from every upload to
+	// detect its type, http.DetectContentType never looks further
+	sniffLen = 512
+
+	// multipartOverhead is allowed on top of the maximum file size for
+	// multipart boundaries, part headers and the other form fields
+	multipartOverhead = 1 << 20
+
+	// maxFieldSize is the maximum size of a non-file form field
+	maxFieldSize = 64 << 10
+)
+
+// upload is a file received from a client. The contents are spooled to a
+// temporary file which is removed by Close.
+type upload struct {
+	File        *os.File
+	Filename    string
+	ContentType string
+	Size        int64
+	// Head holds the first bytes of the file for type detection
+	Head []byte
+	// Hash is the hex encoded SHA-256 of the file
+	Hash string
+	// Fields holds the other form fields of the request
+	Fields url.Values
+	// PasswordHash is the bcrypt hash of the download password if it was
+	// hashed beforehand, it takes the place of the password field
+	PasswordHash string
+}
+
+// uploadOptions holds the settings chosen by the client for an upload
+type uploadOptions struct {
+	ExpiresAt    *time.Time
+	MaxDownloads *int
+	// Password holds the bcrypt hash of the download password
+	Password *string
+	Private  bool
+}
+
+// parseUploadOptions reads the upload settings from the form fields of an
+// upload, or the metadata of a resumable upload
+func (e *Env) parseUploadOptions(fields url.Values) (uploadOptions, error) {
+	var opts uploadOptions
+
+	expiresAt, err := e.uploadExpiry(fields.Get("expires"))
+	if err != nil {
+		return opts, err
+	}
+	opts.ExpiresAt = expiresAt
+
+	if downloads := fields.Get("downloads"); downloads != "" {
+		n, err := strconv.Atoi(downloads)
+		if err != nil || n < 1 {
+			return opts, errInvalidLimit
+		}
+		opts.MaxDownloads = &n
+	}
+
+	if password := fields.Get("password"); password != "" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return opts, err
+		}
+		hash := string(hashed)
+		opts.Password = &hash
+	}
+
+	if private := fields.Get("private"); private != "" {
+		opts.Private, err = strconv.ParseBool(private)
+		if err != nil {
+			return opts, errInvalidPrivate
+		}
+	}
+
+	return opts, nil
+}
+
+// Close removes the temporary file
+func (u *upload) Close() error {
+	u.File.Close()
+	return os.Remove(u.File.Name())
+}
+
+// storeUpload checks an upload against the blocked MIME types, the
+// restrictions of the API key it was made with, if any, and the quota of
+// the account. It records the upload for the account under a newly
+// generated name, storing the content unless it has been uploaded before.
+func (e *Env) storeUpload(accountID int, key *APIKey, up *upload) (UserFile, error) {
+	var file UserFile
+
+	// Parameters such as the charset aren't stored, see contentType
+	mimeType := mediaType(tools.DetectMimeType(up.Head))
+	if e.fileBlocked(up.ContentType) || e.fileBlocked(mimeType) ||
+		e.fileBlocked(http.DetectContentType(up.Head)) {
+		return file, errFileBlocked
+	}
+
+	if key != nil {
+		if key.MaxFileSize != nil && up.Size > *key.MaxFileSize {
+			return file, errFileTooLarge
+		}
+		if !key.allowsMimeType(mimeType) {
+			return file, errFileTypeNotAllowed
+		}
+	}
+
+	// Checked again below, but this saves storing a file that can't be kept
+	if err := checkQuota(e.DB, accountID, up.Size); err != nil {
+		return file, err
+	}
+
+	opts, err := e.parseUploadOptions(up.Fields)
+	if err != nil {
+		return file, err
+	}
+	if up.PasswordHash != "" {
+		opts.Password = &up.PasswordHash
+	}
+
+	fileName, err := tools.GenerateFileName(e.DB, up.Head, up.Filename)
+	if err != nil {
+		return file, err
+	}
+
+	if err := acquireBlob(e.DB, e.Storage, up.Hash, up.Size, up.File); err != nil {
+		return file, err
+	}
+
+	err = inTx(e.DB, func(tx *Tx) error {
+		if err := lockAccount(tx, accountID); err != nil {
+			return err
+		}
+		if err := checkQuota(tx, accountID, up.Size); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`INSERT INTO user_files
+			(account_id, name, original_name, size, mime_type, blob_hash,
+			expires_at, max_downloads, password, private)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			accountID, fileName, originalName(up.Filename), up.Size, mimeType,
+			up.Hash, opts.ExpiresAt, opts.MaxDownloads, opts.Password, opts.Private)
+		if err != nil {
+			return err
+		}
+		return logUpload(tx, accountID, up.Size)
+	})
+	if err != nil {
+		releaseBlob(e.DB, e.Storage, up.Hash)
+		return file, err
+	}
+
+	err = e.DB.Get(&file, "SELECT * FROM user_files WHERE name=?", fileName)
+	return file, err
+}
+
+// originalName cleans up the file name sent by the client so that it fits
+// in user_files
+func originalName(name string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" {
+		return ""
+	}
+
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// receiveUpload streams the multipart form in r to a temporary file in
+// tempDir without buffering the file in memory. The file has to be sent in
+// the "file" field and be smaller than maxSize.
+func receiveUpload(w http.ResponseWriter, r *http.Request, maxSize int64,
+	tempDir string) (*upload, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+multipartOverhead)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	var u *upload
+	fields := url.Values{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if u != nil {
+				u.Close()
+			}
+			return nil, bodyError(err)
+		}
+
+		switch {
+		case part.FormName() == "file" && part.FileName() != "" && u == nil:
+			u, err = spoolPart(part, maxSize, tempDir)
+		case part.FileName() == "":
+			var value []byte
+			value, err = ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+			fields.Add(part.FormName(), string(value))
+		}
+		part.Close()
+
+		if err != nil {
+			if u != nil {
+				u.Close()
+			}
+			return nil, bodyError(err)
+		}
+	}
+
+	if u == nil {
+		return nil, errNoFile
+	}
+	u.Fields = fields
+	return u, nil
+}
+
+// spoolPart copies part to a temporary file while hashing it and keeping
+// its first bytes
+func spoolPart(part *multipart.Part, maxSize int64, tempDir string) (*upload, error) {
+	f, err := ioutil.TempFile(tempDir, "gohst-upload-")
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		File:        f,
+		Filename:    part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+	}
+
+	u.Size, u.Head, u.Hash, err = spool(f, part, maxSize)
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// spool copies at most maxSize bytes from r to f, then rewinds f. It
+// returns the number of bytes copied, the first sniffLen bytes and the hex
+// encoded SHA-256 of the data.
+func spool(f *os.File, r io.Reader, maxSize int64) (int64, []byte, string, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, nil, "", err
+	}
+	head = head[:n]
+
+	h := sha256.New()
+	dst := io.MultiWriter(f, h)
+	if _, err := dst.Write(head); err != nil {
+		return 0, nil, "", err
+	}
+
+	rest, err := io.Copy(dst, io.LimitReader(r, maxSize-int64(n)))
+	if err != nil {
+		return 0, nil, "", err
+	}
+
+	size := int64(n) + rest
+	if size >= maxSize {
+		return 0, nil, "", errFileTooLarge
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, "", err
+	}
+	return size, head, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openUpload prepares a complete file on disk, such as an assembled tus
+// upload, to be stored like a received upload
+func openUpload(path, filename, contentType string, fields url.Values) (*upload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		File:        f,
+		Filename:    filename,
+		ContentType: contentType,
+		Fields:      fields,
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, err
+	}
+	u.Head = head[:n]
+
+	h := sha256.New()
+	h.Write(u.Head)
+	rest, err := io.Copy(h, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	u.Size = int64(n) + rest
+	u.Hash = hex.EncodeToString(h.Sum(nil))
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// bodyError translates the error returned when reading past the limit set
+// by http.MaxBytesReader
+func bodyError(err error) error {
+	if err.Error() == "http: request body too large" {
+		return errFileTooLarge
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// multipartBody returns a multipart form with the fields and, unless
+// filename is empty, a file along with its content type
+func multipartBody(t *testing.T, fields map[string]string, filename string,
+	content []byte) ([]byte, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if filename != "" {
+		fw, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+// receiveTestUpload sends body to receiveUpload with a temporary directory
+// of its own, which is returned to check for leftovers
+func receiveTestUpload(t *testing.T, body []byte, contentType string,
+	maxSize int64) (*upload, string, error) {
+	dir, err := ioutil.TempDir("", "gohst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	u, err := receiveUpload(httptest.NewRecorder(), r, maxSize, dir)
+	return u, dir, err
+}
+
+// assertEmpty fails the test if dir holds any files, then removes it
+func assertEmpty(t *testing.T, dir string) {
+	defer os.RemoveAll(dir)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) > 0 {
+		t.Errorf("%d temporary files left behind", len(infos))
+	}
+}
+
+func TestReceiveUpload(t *testing.T) {
+	content := bytes.Repeat([]byte("gohst "), 100<<10)
+	body, ct := multipartBody(t, map[string]string{"expires": "1d"}, "a.txt", content)
+
+	u, dir, err := receiveTestUpload(t, body, ct, int64(len(content))+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(content)
+	if u.Filename != "a.txt" || u.Size != int64(len(content)) ||
+		u.Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("got %s of %d bytes hashing to %s", u.Filename, u.Size, u.Hash)
+	}
+	if !bytes.Equal(u.Head, content[:sniffLen]) {
+		t.Error("head isn't the start of the file")
+	}
+	if u.Fields.Get("expires") != "1d" {
+		t.Errorf("got expires %q, want %q", u.Fields.Get("expires"), "1d")
+	}
+
+	stored, err := ioutil.ReadAll(u.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Error("spooled file differs from the upload")
+	}
+
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertEmpty(t, dir)
+}
+
+func TestReceiveUploadTooLarge(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 4096)
+	body, ct := multipartBody(t, nil, "a.txt", content)
+
+	// The file has to be smaller than the limit
+	_, dir, err := receiveTestUpload(t, body, ct, int64(len(content)))
+	if err != errFileTooLarge {
+		t.Errorf("got %v for a file of the maximum size, want %v", err, errFileTooLarge)
+	}
+	assertEmpty(t, dir)
+
+	// Smaller than the first bytes kept for type detection
+	_, dir, err = receiveTestUpload(t, body, ct, 16)
+	if err != errFileTooLarge {
+		t.Errorf("got %v for a file above a small limit, want %v", err, errFileTooLarge)
+	}
+	assertEmpty(t, dir)
+}
+
+func TestReceiveUploadBodyTooLarge(t *testing.T) {
+	// Large enough to hit the limit on the whole request body
+	content := bytes.Repeat([]byte("x"), multipartOverhead+8192)
+	body, ct := multipartBody(t, nil, "a.txt", content)
+
+	_, dir, err := receiveTestUpload(t, body, ct, 1024)
+	if err != errFileTooLarge {
+		t.Errorf("got %v for an oversized body, want %v", err, errFileTooLarge)
+	}
+	assertEmpty(t, dir)
+}
+
+func TestReceiveUploadTruncated(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 8192)
+	body, ct := multipartBody(t, nil, "a.txt", content)
+
+	// The connection drops in the middle of the file
+	_, dir, err := receiveTestUpload(t, body[:len(body)/2], ct, 1<<20)
+	if err == nil {
+		t.Error("truncated upload accepted")
+	}
+	assertEmpty(t, dir)
+}
+
+func TestReceiveUploadNoFile(t *testing.T) {
+	body, ct := multipartBody(t, map[string]string{"expires": "1d"}, "", nil)
+
+	_, dir, err := receiveTestUpload(t, body, ct, 1<<20)
+	if err != errNoFile {
+		t.Errorf("got %v without a file, want %v", err, errNoFile)
+	}
+	assertEmpty(t, dir)
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tempPrefix starts the names of the temporary files written by Put
+const tempPrefix = ".upload-"
+
+// Local stores files in a directory on the local filesystem
+type Local struct {
+	Dir string
+}
+
+// NewLocal returns a Local storage rooted at dir
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+// Put writes r to a temporary file in the directory, then renames it into
+// place so that readers never see a partially written file.
+func (l *Local) Put(name string, r io.Reader) error {
+	f, err := ioutil.TempFile(l.Dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), l.path(name))
+}
+
+func (l *Local) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (l *Local) Stat(name string) (FileInfo, error) {
+	fi, err := os.Stat(l.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return FileInfo{}, ErrNotExist
+		}
+		return FileInfo{}, err
+	}
+	return fileInfo(fi), nil
+}
+
+func (l *Local) Delete(name string) error {
+	err := os.Remove(l.path(name))
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
+
+func (l *Local) List() ([]FileInfo, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []FileInfo
+	for _, fi := range files {
+		if fi.IsDir() || fi.Name()[0] == '.' {
+			continue
+		}
+		infos = append(infos, fileInfo(fi))
+	}
+	return infos, nil
+}
+
+// Reap deletes the temporary files of Puts that never finished
+func (l *Local) Reap(age time.Duration) error {
+	names, err := filepath.Glob(filepath.Join(l.Dir, tempPrefix+"*"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		if time.Since(fi.ModTime()) > age {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// path returns the location of name inside the directory, stripping any
+// directory components so that a name can never escape it
+func (l *Local) path(name string) string {
+	return filepath.Join(l.Dir, filepath.Base(filepath.Clean("/"+name)))
+}
+
+func fileInfo(fi os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+}
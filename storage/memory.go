@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory keeps files in memory. Its contents are lost when the process
+// exits, which makes it mostly useful for development and tests.
+type Memory struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory returns an empty Memory storage
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]memoryFile)}
+}
+
+func (m *Memory) Put(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.files[name] = memoryFile{data: data, modTime: time.Now()}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) Get(name string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	f, ok := m.files[name]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return memoryReader{bytes.NewReader(f.data)}, nil
+}
+
+func (m *Memory) Stat(name string) (FileInfo, error) {
+	m.mu.RLock()
+	f, ok := m.files[name]
+	m.mu.RUnlock()
+	if !ok {
+		return FileInfo{}, ErrNotExist
+	}
+	return FileInfo{Name: name, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (m *Memory) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return ErrNotExist
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *Memory) List() ([]FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	infos := make([]FileInfo, 0, len(m.files))
+	for name, f := range m.files {
+		infos = append(infos, FileInfo{Name: name, Size: int64(len(f.data)), ModTime: f.modTime})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// memoryReader adds a no-op Close to bytes.Reader while keeping Seek
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error { return nil }
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize is the size of the parts used for multipart uploads. Uploads
+// are streamed with an unknown length, so every part is buffered in memory.
+const s3PartSize = 16 << 20
+
+// S3Config holds the settings needed to connect to an S3-compatible bucket
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	PathStyle bool
+	// Prefix is prepended to every object key
+	Prefix string
+	// Presign makes URL return presigned links valid for this long instead
+	// of downloads being streamed through the server. Zero disables it.
+	Presign time.Duration
+}
+
+// S3 stores files in an S3-compatible object storage bucket
+type S3 struct {
+	client *minio.Client
+	config S3Config
+}
+
+// NewS3 connects to the bucket described by config
+func NewS3(config S3Config) (*S3, error) {
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       config.UseSSL,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{client: client, config: config}, nil
+}
+
+func (s *S3) Put(name string, r io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), s.config.Bucket,
+		s.key(name), r, -1, minio.PutObjectOptions{PartSize: s3PartSize})
+	return err
+}
+
+// Get returns a reader for the object. The reader is seekable, seeking
+// issues ranged requests to the bucket.
+func (s *S3) Get(name string) (io.ReadCloser, error) {
+	// GetObject doesn't fail for missing objects until the first read,
+	// stat first so that callers get ErrNotExist right away
+	if _, err := s.Stat(name); err != nil {
+		return nil, err
+	}
+
+	return s.client.GetObject(context.Background(), s.config.Bucket,
+		s.key(name), minio.GetObjectOptions{})
+}
+
+func (s *S3) Stat(name string) (FileInfo, error) {
+	info, err := s.client.StatObject(context.Background(), s.config.Bucket,
+		s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return FileInfo{}, s3Error(err)
+	}
+	return FileInfo{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3) Delete(name string) error {
+	// RemoveObject succeeds for missing keys, so check explicitly to
+	// behave like the other backends
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+
+	return s.client.RemoveObject(context.Background(), s.config.Bucket,
+		s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *S3) List() ([]FileInfo, error) {
+	var infos []FileInfo
+	objects := s.client.ListObjects(context.Background(), s.config.Bucket,
+		minio.ListObjectsOptions{Prefix: s.config.Prefix, Recursive: true})
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		infos = append(infos, FileInfo{
+			Name:    strings.TrimPrefix(obj.Key, s.config.Prefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+	return infos, nil
+}
+
+// URL returns a presigned download link for the object, or an empty string
+// if presigning is disabled
+func (s *S3) URL(name, contentType, contentDisposition string) (string, error) {
+	if s.config.Presign <= 0 {
+		return "", nil
+	}
+
+	params := url.Values{}
+	if contentType != "" {
+		params.Set("response-content-type", contentType)
+	}
+	if contentDisposition != "" {
+		params.Set("response-content-disposition", contentDisposition)
+	}
+
+	u, err := s.client.PresignedGetObject(context.Background(), s.config.Bucket,
+		s.key(name), s.config.Presign, params)
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return u.String(), nil
+}
+
+func (s *S3) key(name string) string {
+	return s.config.Prefix + path.Base(path.Clean("/"+name))
+}
+
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 implements the part of the S3 API used by S3, keeping the objects
+// of every bucket in memory. Requests aren't authenticated.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]map[int][]byte
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+type fakeContents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type fakeListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []fakeContents
+}
+
+type fakeInitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type fakeCompleteResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+type fakeError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string]fakeObject),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Buckets are addressed by path, objects are kept under bucket/key
+	bucket := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && strings.TrimSuffix(name, "/") == bucket:
+		f.list(w, bucket, q.Get("prefix"))
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = make(map[int][]byte)
+		writeXML(w, http.StatusOK, fakeInitiateResult{Bucket: bucket,
+			Key: strings.TrimPrefix(name, bucket+"/"), UploadID: id})
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		n, err := strconv.Atoi(q.Get("partNumber"))
+		if !ok || err != nil {
+			writeXML(w, http.StatusNotFound, fakeError{Code: "NoSuchUpload"})
+			return
+		}
+		data := readBody(r)
+		parts[n] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			writeXML(w, http.StatusNotFound, fakeError{Code: "NoSuchUpload"})
+			return
+		}
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		f.objects[name] = fakeObject{data: data, modTime: time.Now()}
+		writeXML(w, http.StatusOK, fakeCompleteResult{Bucket: bucket,
+			Key: strings.TrimPrefix(name, bucket+"/"), ETag: etag(data)})
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data := readBody(r)
+		f.objects[name] = fakeObject{data: data, modTime: time.Now()}
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[name]
+		if !ok {
+			writeXML(w, http.StatusNotFound, fakeError{Code: "NoSuchKey",
+				Message: "The specified key does not exist."})
+			return
+		}
+		if ct := q.Get("response-content-type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		if cd := q.Get("response-content-disposition"); cd != "" {
+			w.Header().Set("Content-Disposition", cd)
+		}
+		w.Header().Set("ETag", etag(obj.data))
+		http.ServeContent(w, r, name, obj.modTime, bytes.NewReader(obj.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeXML(w, http.StatusNotImplemented, fakeError{Code: "NotImplemented"})
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	res := fakeListResult{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+	for name, obj := range f.objects {
+		key := strings.TrimPrefix(name, bucket+"/")
+		if key == name || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		res.Contents = append(res.Contents, fakeContents{
+			Key:          key,
+			LastModified: obj.modTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(obj.data),
+			Size:         int64(len(obj.data)),
+		})
+	}
+	sort.Slice(res.Contents, func(i, j int) bool {
+		return res.Contents[i].Key < res.Contents[j].Key
+	})
+	res.KeyCount = len(res.Contents)
+	writeXML(w, http.StatusOK, res)
+}
+
+// readBody returns the body of an upload, decoding the chunks it is sent in
+// when streaming signatures are used
+func readBody(r *http.Request) []byte {
+	body, _ := ioutil.ReadAll(r.Body)
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return body
+	}
+
+	// Every chunk is "<hex size>[;chunk-signature=...]\r\n<data>\r\n", the
+	// last one is empty
+	var data []byte
+	for {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			return data
+		}
+		header := string(body[:i])
+		size, err := strconv.ParseInt(strings.SplitN(header, ";", 2)[0], 16, 64)
+		if err != nil || size == 0 || int64(len(body)) < int64(i)+2+size {
+			return data
+		}
+		body = body[i+2:]
+		data = append(data, body[:size]...)
+		body = bytes.TrimPrefix(body[size:], []byte("\r\n"))
+	}
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// newTestS3 returns an S3 storage backed by a fake server
+func newTestS3(t *testing.T, presign time.Duration) (*S3, *fakeS3, func()) {
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+
+	s, err := NewS3(S3Config{
+		Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		Bucket:    "gohst",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+		Prefix:    "files/",
+		Presign:   presign,
+	})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return s, fake, srv.Close
+}
+
+func TestS3PutGet(t *testing.T) {
+	s, fake, closeS3 := newTestS3(t, 0)
+	defer closeS3()
+
+	if err := s.Put("a.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["gohst/files/a.txt"]; !ok {
+		t.Fatal("object not stored under the prefix")
+	}
+
+	r, err := s.Get("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got %q, want %q", data, "hello")
+	}
+
+	if _, err := s.Get("missing.txt"); err != ErrNotExist {
+		t.Errorf("got %v for a missing object, want %v", err, ErrNotExist)
+	}
+}
+
+func TestS3PutLarge(t *testing.T) {
+	s, _, closeS3 := newTestS3(t, 0)
+	defer closeS3()
+
+	// Spans more than one part of the multipart upload
+	data := bytes.Repeat([]byte("0123456789abcdef"), s3PartSize/16+1)
+	if err := s.Put("large.bin", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat("large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("got %d bytes, want %d", info.Size, len(data))
+	}
+}
+
+func TestS3Stat(t *testing.T) {
+	s, _, closeS3 := newTestS3(t, 0)
+	defer closeS3()
+
+	if err := s.Put("a.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "a.txt" || info.Size != 5 || info.ModTime.IsZero() {
+		t.Errorf("got %+v for a.txt of 5 bytes", info)
+	}
+
+	if _, err := s.Stat("missing.txt"); err != ErrNotExist {
+		t.Errorf("got %v for a missing object, want %v", err, ErrNotExist)
+	}
+}
+
+func TestS3Delete(t *testing.T) {
+	s, _, closeS3 := newTestS3(t, 0)
+	defer closeS3()
+
+	if err := s.Put("a.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("a.txt"); err != ErrNotExist {
+		t.Errorf("got %v after deleting, want %v", err, ErrNotExist)
+	}
+	if err := s.Delete("a.txt"); err != ErrNotExist {
+		t.Errorf("got %v deleting a missing object, want %v", err, ErrNotExist)
+	}
+}
+
+func TestS3List(t *testing.T) {
+	s, fake, closeS3 := newTestS3(t, 0)
+	defer closeS3()
+
+	for _, name := range []string{"b.txt", "a.txt"} {
+		if err := s.Put(name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Outside of the prefix
+	fake.objects["gohst/other.txt"] = fakeObject{data: []byte("other")}
+
+	infos, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	if fmt.Sprint(names) != "[a.txt b.txt]" {
+		t.Errorf("listed %v, want [a.txt b.txt]", names)
+	}
+}
+
+func TestS3URL(t *testing.T) {
+	s, _, closeS3 := newTestS3(t, 0)
+	if u, err := s.URL("a.txt", "", ""); err != nil || u != "" {
+		t.Errorf("got %q, %v without presigning, want an empty URL", u, err)
+	}
+	closeS3()
+
+	s, _, closeS3 = newTestS3(t, time.Minute)
+	defer closeS3()
+	if err := s.Put("a.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := s.URL("a.txt", "text/plain", "attachment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/gohst/files/a.txt" || q.Get("X-Amz-Signature") == "" ||
+		q.Get("X-Amz-Expires") != "60" {
+		t.Errorf("got %s, want a link to gohst/files/a.txt signed for 60s", link)
+	}
+	if q.Get("response-content-type") != "text/plain" ||
+		q.Get("response-content-disposition") != "attachment" {
+		t.Errorf("got %s, want the response headers in the link", link)
+	}
+
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if string(data) != "hello" {
+		t.Errorf("link served %q, want %q", data, "hello")
+	}
+}
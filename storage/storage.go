@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotExist is returned when a file is not present in the storage backend
+var ErrNotExist = errors.New("storage: file does not exist")
+
+// Storage is implemented by the backends that hold uploaded files
+type Storage interface {
+	// Put stores the contents of r under name, replacing any existing file
+	Put(name string, r io.Reader) error
+	// Get opens the file stored under name. The returned reader also
+	// implements io.Seeker if the backend supports it.
+	Get(name string) (io.ReadCloser, error)
+	// Stat returns information about the file stored under name
+	Stat(name string) (FileInfo, error)
+	// Delete removes the file stored under name
+	Delete(name string) error
+	// List returns information about every stored file
+	List() ([]FileInfo, error)
+}
+
+// Redirector is implemented by backends that can hand out direct download
+// links, so that the server can redirect instead of streaming the file.
+// The download is served with the supplied Content-Type and
+// Content-Disposition headers if they aren't empty. An empty URL means
+// that the file has to be streamed.
+type Redirector interface {
+	URL(name, contentType, contentDisposition string) (string, error)
+}
+
+// Reaper is implemented by backends that keep temporary files while a file
+// is stored, which are left behind if the server dies in the meantime
+type Reaper interface {
+	// Reap deletes the temporary files that are older than age
+	Reap(age time.Duration) error
+}
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
@@ -0,0 +1,34 @@
+package tools
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDuration parses a duration string like time.ParseDuration, but
+// also accepts a number of days or weeks such as "7d" or "2w". Those have
+// to be positive or zero and fit in a time.Duration.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	n *= float64(unit)
+	// The comparisons are false for NaN
+	if err != nil || !(n >= 0 && n < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(n), nil
+}
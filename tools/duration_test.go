@@ -0,0 +1,40 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"90m", 90 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"7d", 7 * 24 * time.Hour},
+		{" 2w ", 14 * 24 * time.Hour},
+		{"0.5d", 12 * time.Hour},
+		{"0d", 0},
+	} {
+		got, err := ParseDuration(c.in)
+		if err != nil {
+			t.Errorf("ParseDuration(%q): %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ParseDuration(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseDurationInvalid(t *testing.T) {
+	for _, in := range []string{
+		"", "d", "xd", "-1d", "-0.5w", "NaNd", "nanw", "Infd", "+infw", "-infd",
+		"1e300d", "106752d", "15251w",
+	} {
+		if d, err := ParseDuration(in); err == nil {
+			t.Errorf("ParseDuration(%q) = %v, want an error", in, d)
+		}
+	}
+}
@@ -1,54 +1,24 @@
 package tools
 
 import (
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"log"
 	"time"
 )
 
-const SCAN_INTERVAL = time.Hour * 24
-
-// StartScanner starts a scanner which scans a directory and deletes
-// files that are older than maxAge
-func StartScanner(directory, maxAge string) error {
+// StartScanner runs scan every interval, logging the errors it returns,
+// until stop is closed. A scan that is running is finished first.
+func StartScanner(interval time.Duration, scan func() error, stop <-chan struct{}) {
 	for {
-		err := scanDirectory(directory, maxAge)
-		if err != nil {
-			return err
+		if err := scan(); err != nil {
+			log.Println(err)
 		}
 
-		time.Sleep(SCAN_INTERVAL)
-	}
-}
-
-func scanDirectory(directory, maxAge string) error {
-	files, err := ioutil.ReadDir(directory)
-	if err != nil {
-		return err
-	}
-
-	maxDur, err := time.ParseDuration(maxAge)
-	if err != nil {
-		return err
-	}
-
-	for _, file := range files {
-		path := filepath.Join(directory, file.Name())
-		fi, err := os.Stat(path)
-		if err != nil {
-			return err
-		}
-
-		if time.Since(fi.ModTime()) >= maxDur {
-			err = os.Remove(path)
-			if err != nil {
-				return err
-			}
-			fmt.Printf("deleted file %v!\n", path)
+		t := time.NewTimer(interval)
+		select {
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return
 		}
 	}
-
-	return nil
 }
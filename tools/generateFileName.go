@@ -9,12 +9,18 @@ import (
 	"time"
 
 	"github.com/h2non/filetype"
-	"github.com/jmoiron/sqlx"
 )
 
-func GenerateFileName(db *sqlx.DB, file []byte, originalFileName string) (string, error) {
+// Getter is the part of a database connection GenerateFileName uses
+type Getter interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+}
+
+// GenerateFileName returns an unoccupied file name with an extension based
+// on the file type. head only needs to hold the first bytes of the file.
+func GenerateFileName(db Getter, head []byte, originalFileName string) (string, error) {
 	var fileName string
-	ft, err := filetype.Match(file)
+	ft, err := filetype.Match(head)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,16 @@
+package tools
+
+import (
+	"net/http"
+
+	"github.com/h2non/filetype"
+)
+
+// DetectMimeType returns the MIME type of a file based on its first bytes
+func DetectMimeType(head []byte) string {
+	ft, err := filetype.Match(head)
+	if err == nil && ft != filetype.Unknown {
+		return ft.MIME.Value
+	}
+	return http.DetectContentType(head)
+}
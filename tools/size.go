@@ -0,0 +1,41 @@
+package tools
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"t", 1 << 40},
+	{"g", 1 << 30},
+	{"m", 1 << 20},
+	{"k", 1 << 10},
+	{"", 1},
+}
+
+// ParseSize parses a size in bytes such as "500", "10k", "1.5GB" or
+// "100MiB". The units are powers of 1024.
+func ParseSize(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "b"), "i")
+
+	for _, u := range sizeUnits {
+		if !strings.HasSuffix(v, u.suffix) {
+			continue
+		}
+
+		n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), 64)
+		n *= float64(u.size)
+		// The comparisons are false for NaN
+		if err != nil || !(n >= 0 && n < math.MaxInt64) {
+			break
+		}
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("invalid size %q", s)
+}